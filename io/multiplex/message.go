@@ -0,0 +1,53 @@
+package multiplex
+
+import (
+	"io"
+)
+
+// MessageConn sends and receives whole messages rather than a stream of
+// bytes. A Stream is a MessageConn.
+type MessageConn interface {
+	SendMsg([]byte) error
+	RecvMsg() ([]byte, error)
+	Close() error
+}
+
+// SendMsg sends m as a single message. The peer receives it in one piece
+// from RecvMsg, regardless of its size.
+//
+// If SendMsg fails after part of m has been sent, the stream is closed since
+// the peer can no longer tell where messages begin.
+func (st *Stream) SendMsg(m []byte) error {
+	n, err := st.send(m, true)
+	if err != nil && n > 0 {
+		st.Close()
+	}
+	return err
+}
+
+// RecvMsg returns the next message sent with SendMsg. Data written with Write
+// is returned in arbitrarily sized pieces. Read and RecvMsg should not be
+// mixed unless messages are read in full.
+//
+// If the stream ends part-way through a message, RecvMsg returns
+// io.ErrUnexpectedEOF.
+func (st *Stream) RecvMsg() ([]byte, error) {
+	st.rmu.Lock()
+	defer st.rmu.Unlock()
+	m := []byte{}
+	for partial := false; ; partial = true {
+		if err := st.lockData(); err != nil {
+			if partial && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		c := st.rq[0]
+		st.rq = st.rq[1:]
+		m = append(m, c.p...)
+		st.consume(len(c.p))
+		if !c.more {
+			return m, nil
+		}
+	}
+}
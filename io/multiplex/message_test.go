@@ -0,0 +1,52 @@
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMessages(t *testing.T) {
+	s0, s1 := sessionPair(1, nil)
+	defer s0.Close()
+	defer s1.Close()
+
+	var mc0, mc1 MessageConn = s0.Streams()[0], s1.Streams()[0]
+	msgs := [][]byte{
+		msg0,
+		{},
+		bytes.Repeat(msg1, window), // larger than a frame and the window
+		msg1,
+	}
+	go func() {
+		for _, m := range msgs {
+			if err := mc0.SendMsg(m); err != nil {
+				return
+			}
+		}
+		mc0.Close()
+	}()
+	for i, m := range msgs {
+		r, err := mc1.RecvMsg()
+		if err != nil {
+			t.Fatalf("RecvMsg %d: %v", i, err)
+		}
+		if !bytes.Equal(r, m) {
+			t.Fatalf("message %d: expected %d bytes, got %d", i, len(m), len(r))
+		}
+	}
+	if _, err := mc1.RecvMsg(); err != io.EOF {
+		t.Errorf("expected %v, got %v", io.EOF, err)
+	}
+}
+
+func TestMessageTruncated(t *testing.T) {
+	s0, s1 := sessionPair(1, nil)
+	defer s1.Close()
+	s0.write(frame{Type: frameData, Stream: 0, More: true, Payload: msg0}, time.Time{}, nil)
+	s0.Close()
+	if _, err := s1.Streams()[0].RecvMsg(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
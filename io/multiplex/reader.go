@@ -29,6 +29,8 @@ func (p *rproxy) Close() error {
 
 // Split a ReadCloser into 'n' ReadClosers. When all returned ReadClosers have
 // been Close()'d, then the underlying ReadCloser is also closed.
+//
+// This reads the legacy wire format, which is not compatible with Session.
 func SplitReadCloser(rc io.ReadCloser, n uint) []io.ReadCloser {
 	var r []io.ReadCloser
 	var w []io.WriteCloser
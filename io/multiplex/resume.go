@@ -0,0 +1,320 @@
+package multiplex
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Resumable sessions start each connection with the preamble and a
+// fixed-size hello, before any gob data, so that the accepting end can read
+// it and decide which session the connection belongs to:
+//
+//	kind:  1 byte (helloNew, helloResume or helloReject)
+//	token: 16 bytes (random nonce for helloNew, session token otherwise)
+//	seq:   8 bytes, big endian (last frame received by the sender)
+//
+// The token of a new session is the XOR of the nonces of both ends.
+
+const (
+	helloNew byte = iota + 1
+	helloResume
+	helloReject
+)
+
+const helloLen = 1 + len(Token{}) + 8
+
+// ErrResumeRejected is returned when the peer no longer knows the session
+// being resumed. The session fails with this error.
+var ErrResumeRejected = errors.New("govtil/io/multiplex: peer rejected session resumption")
+
+// Token identifies a resumable session. Both ends compute the same token.
+type Token [16]byte
+
+func (t Token) String() string {
+	return fmt.Sprintf("%x", t[:])
+}
+
+// Hello is the handshake that starts each connection of a resumable session.
+type Hello struct {
+	Resume bool   // connection resumes the session identified by Token
+	Token  Token  // for a new session, a random nonce
+	Seq    uint64 // last frame received by the sender
+	reject bool
+}
+
+// ReadHello reads the hello that starts a connection of a resumable session.
+// The accepting end of a connection uses it to choose between AcceptSession
+// and Session.Resume.
+func ReadHello(r io.Reader) (*Hello, error) {
+	if err := readPreamble(r); err != nil {
+		return nil, err
+	}
+	var b [helloLen]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	h := &Hello{Seq: binary.BigEndian.Uint64(b[1+len(Token{}):])}
+	copy(h.Token[:], b[1:])
+	switch b[0] {
+	case helloNew:
+	case helloResume:
+		h.Resume = true
+	case helloReject:
+		h.reject = true
+	default:
+		return nil, fmt.Errorf("govtil/io/multiplex: bad hello type %v", b[0])
+	}
+	return h, nil
+}
+
+func (h *Hello) write(w io.Writer) error {
+	var b [len(magic) + 1 + helloLen]byte
+	copy(b[:], magic[:])
+	b[len(magic)] = wireVersion
+	h.encode(b[len(magic)+1:])
+	_, err := w.Write(b[:])
+	return err
+}
+
+func (h *Hello) encode(b []byte) {
+	switch {
+	case h.reject:
+		b[0] = helloReject
+	case h.Resume:
+		b[0] = helloResume
+	default:
+		b[0] = helloNew
+	}
+	copy(b[1:], h.Token[:])
+	binary.BigEndian.PutUint64(b[1+len(Token{}):], h.Seq)
+}
+
+// Reject tells a peer that the session it is trying to resume is unknown.
+func Reject(w io.Writer) error {
+	return (&Hello{reject: true}).write(w)
+}
+
+func nonce() (*Hello, error) {
+	h := &Hello{}
+	_, err := rand.Read(h.Token[:])
+	return h, err
+}
+
+func (s *Session) setToken(mine, peer *Hello) {
+	for i := range s.token {
+		s.token[i] = mine.Token[i] ^ peer.Token[i]
+	}
+	close(s.ready)
+}
+
+// exchange writes mine to rwc while reading the peer's hello.
+func exchange(rwc io.ReadWriter, mine *Hello) (*Hello, error) {
+	werr := make(chan error, 1)
+	go func() {
+		werr <- mine.write(rwc)
+	}()
+	peer, err := ReadHello(rwc)
+	if err != nil {
+		return nil, err
+	}
+	if err := <-werr; err != nil {
+		return nil, err
+	}
+	if peer.reject {
+		return nil, ErrResumeRejected
+	}
+	return peer, nil
+}
+
+// handshake starts a new resumable session over rwc from either end.
+func (s *Session) handshake(rwc io.ReadWriteCloser) error {
+	mine, err := nonce()
+	if err != nil {
+		return err
+	}
+	peer, err := exchange(rwc, mine)
+	if err != nil {
+		return err
+	}
+	if peer.Resume {
+		Reject(rwc)
+		return errors.New("govtil/io/multiplex: peer is resuming, expected a new session")
+	}
+	s.setToken(mine, peer)
+	s.attach(newTransport(rwc), 0)
+	return nil
+}
+
+// AcceptSession starts a new resumable session over rwc, whose hello has
+// already been read with ReadHello. opts must have Resumable set.
+func AcceptSession(rwc io.ReadWriteCloser, peer *Hello, n uint, opts *Options) (*Session, error) {
+	if opts == nil || !opts.Resumable {
+		return nil, errors.New("govtil/io/multiplex: AcceptSession requires resumable options")
+	}
+	if peer.Resume {
+		return nil, errors.New("govtil/io/multiplex: AcceptSession given a resuming hello")
+	}
+	mine, err := nonce()
+	if err != nil {
+		return nil, err
+	}
+	if err := mine.write(rwc); err != nil {
+		return nil, err
+	}
+	s := newSession(n, opts)
+	s.setToken(mine, peer)
+	s.attach(newTransport(rwc), 0)
+	return s, nil
+}
+
+// Token returns the token identifying a resumable session, waiting for the
+// initial handshake if necessary.
+func (s *Session) Token() Token {
+	select {
+	case <-s.ready:
+	case <-s.die:
+	}
+	return s.token
+}
+
+// Resume continues a resumable session over a new connection rwc. Any
+// current connection is dropped. Frames the peer did not receive before the
+// old connection was lost are sent again.
+//
+// If peer is nil, Resume sends this end's hello and reads the peer's.
+// Otherwise peer is the hello already read from rwc with ReadHello.
+func (s *Session) Resume(rwc io.ReadWriteCloser, peer *Hello) error {
+	if !s.opts.Resumable {
+		return errors.New("govtil/io/multiplex: session is not resumable")
+	}
+	select {
+	case <-s.ready:
+	case <-s.die:
+		return s.Err()
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	s.drop(s.transport(), errors.New("govtil/io/multiplex: connection replaced"))
+
+	s.mu.Lock()
+	mine := &Hello{Resume: true, Token: s.token, Seq: s.recvSeq}
+	s.mu.Unlock()
+	var err error
+	if peer == nil {
+		peer, err = exchange(rwc, mine)
+		if err == ErrResumeRejected {
+			s.fail(err)
+		}
+	} else {
+		err = mine.write(rwc)
+	}
+	if err == nil && (!peer.Resume || peer.Token != s.token) {
+		err = fmt.Errorf("govtil/io/multiplex: peer resumed wrong session %v", peer.Token)
+	}
+	if err != nil {
+		rwc.Close()
+		return err
+	}
+	s.attach(newTransport(rwc), peer.Seq)
+	return nil
+}
+
+// encode writes f, assigning it a sequence number and buffering it if the
+// session is resumable.
+func (s *Session) encode(enc *gob.Encoder, f *frame) error {
+	if s.opts.Resumable {
+		s.mu.Lock()
+		if f.Type.sequenced() {
+			s.sendSeq++
+			f.Seq = s.sendSeq
+			b := *f
+			b.Payload = append([]byte(nil), f.Payload...)
+			s.unacked = append(s.unacked, b)
+			s.unackedBytes += len(b.Payload)
+		}
+		f.Ack = s.recvSeq
+		s.ackSent = f.Ack
+		s.mu.Unlock()
+	}
+	return enc.Encode(f)
+}
+
+// resend writes the frames the peer has not received over a new transport.
+func (s *Session) resend(enc *gob.Encoder, ack uint64) error {
+	s.mu.Lock()
+	s.acked(ack)
+	frames := append([]frame(nil), s.unacked...)
+	s.mu.Unlock()
+	for i := range frames {
+		s.mu.Lock()
+		frames[i].Ack = s.recvSeq
+		s.ackSent = frames[i].Ack
+		s.mu.Unlock()
+		if err := enc.Encode(&frames[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// acked discards buffered frames up to ack. s.mu must be held.
+func (s *Session) acked(ack uint64) {
+	i := 0
+	for i < len(s.unacked) && s.unacked[i].Seq <= ack {
+		s.unackedBytes -= len(s.unacked[i].Payload)
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	s.unacked = s.unacked[i:]
+	select {
+	case s.ackc <- struct{}{}:
+	default:
+	}
+}
+
+// unackedFull reports whether a resumable session has buffered MaxUnacked
+// bytes for the peer to acknowledge.
+func (s *Session) unackedFull() bool {
+	if !s.opts.Resumable {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unackedBytes >= s.opts.MaxUnacked
+}
+
+// ackEvery is the number of frames received after which an ack is sent even
+// if there is nothing else to send.
+const ackEvery = 32
+
+// received records a frame read by a resumable session. It returns false if
+// the frame is a duplicate that must not be processed again.
+func (s *Session) received(f *frame) bool {
+	s.mu.Lock()
+	s.acked(f.Ack)
+	if !f.Type.sequenced() {
+		s.mu.Unlock()
+		return true
+	}
+	if f.Seq <= s.recvSeq {
+		s.mu.Unlock()
+		return false
+	}
+	s.recvSeq = f.Seq
+	ack := s.recvSeq-s.ackSent >= ackEvery
+	s.mu.Unlock()
+	if ack {
+		select {
+		case s.ctrl <- frame{Type: frameAck}:
+		default:
+		}
+	}
+	return true
+}
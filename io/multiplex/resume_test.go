@@ -0,0 +1,155 @@
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	vio "github.com/vsekhar/govtil/io"
+)
+
+// pipes returns the two ends of an in-memory connection, and a function that
+// breaks it.
+func pipes() (io.ReadWriteCloser, io.ReadWriteCloser, func()) {
+	a0, a1 := io.Pipe()
+	b0, b1 := io.Pipe()
+	return vio.NewReadWriteCloser(a0, b1), vio.NewReadWriteCloser(b0, a1), func() {
+		a1.CloseWithError(io.ErrUnexpectedEOF)
+		b1.CloseWithError(io.ErrUnexpectedEOF)
+	}
+}
+
+func TestResume(t *testing.T) {
+	opts := &Options{Resumable: true}
+	c0, c1, cut := pipes()
+	s0 := NewSession(c0, 1, opts)
+	s1 := NewSession(c1, 1, opts)
+	defer s0.Close()
+	defer s1.Close()
+	if s0.Token() != s1.Token() {
+		t.Fatalf("tokens differ: %v and %v", s0.Token(), s1.Token())
+	}
+	st0, st1 := s0.Streams()[0], s1.Streams()[0]
+
+	big := bytes.Repeat([]byte("0123456789"), maxFrame)
+	done := make(chan error)
+	go func() {
+		if _, err := st0.Write(msg0); err != nil {
+			done <- err
+			return
+		}
+		_, err := st0.Write(big)
+		done <- err
+	}()
+	r := make([]byte, len(msg0))
+	if _, err := io.ReadFull(st1, r); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+
+	// lose the connection part-way through the large write
+	cut()
+	<-s0.Disconnected()
+	<-s1.Disconnected()
+	if s0.Err() != nil || s1.Err() != nil {
+		t.Fatalf("resumable sessions failed: %v, %v", s0.Err(), s1.Err())
+	}
+
+	c0, c1, _ = pipes()
+	go func() {
+		h, err := ReadHello(c1)
+		if err != nil || !h.Resume || h.Token != s1.Token() {
+			t.Errorf("bad hello %+v: %v", h, err)
+			return
+		}
+		if err := s1.Resume(c1, h); err != nil {
+			t.Errorf("Resume: %v", err)
+		}
+	}()
+	if err := s0.Resume(c0, nil); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	r = make([]byte, len(big))
+	if _, err := io.ReadFull(st1, r); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if !bytes.Equal(r, big) {
+		t.Fatalf("payload corrupted across resume")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+func TestResumeTimeout(t *testing.T) {
+	opts := &Options{Resumable: true, ResumeTimeout: 20 * time.Millisecond}
+	c0, c1, cut := pipes()
+	s0 := NewSession(c0, 1, opts)
+	NewSession(c1, 1, opts)
+	s0.Token()
+	cut()
+	select {
+	case <-s0.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("session not closed after resume timeout")
+	}
+	if _, err := s0.Streams()[0].Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected error reading from expired session")
+	}
+}
+
+func TestResumeRejected(t *testing.T) {
+	opts := &Options{Resumable: true}
+	c0, c1, cut := pipes()
+	s0 := NewSession(c0, 1, opts)
+	NewSession(c1, 1, opts)
+	s0.Token()
+	cut()
+
+	c0, c1, _ = pipes()
+	go func() {
+		ReadHello(c1)
+		Reject(c1)
+	}()
+	if err := s0.Resume(c0, nil); err != ErrResumeRejected {
+		t.Fatalf("expected %v, got %v", ErrResumeRejected, err)
+	}
+	if s0.Err() != ErrResumeRejected {
+		t.Errorf("expected session error %v, got %v", ErrResumeRejected, s0.Err())
+	}
+}
+
+func TestMaxUnacked(t *testing.T) {
+	opts := &Options{Resumable: true, MaxUnacked: 4 << 10}
+	c0, c1, _ := pipes()
+	// a peer that completes the handshake but never acknowledges anything
+	go func() {
+		if _, err := ReadHello(c1); err != nil {
+			return
+		}
+		(&Hello{}).write(c1)
+		io.Copy(ioutil.Discard, c1)
+	}()
+	s0 := NewSession(c0, 1, opts)
+	defer s0.Close()
+	s0.Token()
+
+	st0 := s0.Streams()[0]
+	st0.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	chunk := make([]byte, 1<<10)
+	var err error
+	for i := 0; i < 64 && err == nil; i++ {
+		_, err = st0.Write(chunk)
+	}
+	if err != ErrTimeout {
+		t.Fatalf("expected writes to block until ErrTimeout, got %v", err)
+	}
+	s0.mu.Lock()
+	n := s0.unackedBytes
+	s0.mu.Unlock()
+	if n > opts.MaxUnacked+maxFrame {
+		t.Errorf("%d bytes unacknowledged, limit %d", n, opts.MaxUnacked)
+	}
+}
@@ -13,6 +13,8 @@ var msg1 []byte = []byte("def456")
 
 var msgs [][]byte = [][]byte{msg0, msg1}
 
+// SplitReadWriteCloser splits rwc into n streams using the legacy wire format
+// of SplitReadCloser and SplitWriteCloser. It cannot talk to a Session.
 func SplitReadWriteCloser(rwc io.ReadWriteCloser, n uint) []io.ReadWriteCloser {
 	rcs := SplitReadCloser(rwc, n)
 	wcs := SplitWriteCloser(rwc, n)
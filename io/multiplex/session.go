@@ -0,0 +1,1113 @@
+// Package multiplex carries several streams over one io.ReadWriteCloser.
+//
+// It speaks two wire formats that cannot talk to each other:
+//
+// Session (NewSession, including resumable sessions) frames each stream's data
+// with flow control and exchanges keepalive pings. This is the format used by
+// govtil/net/multiplex, and so by birpc, since Split moved to it.
+//
+// The legacy format of SplitReadCloser, SplitWriteCloser and
+// SplitReadWriteCloser gob-encodes each write with only its stream number. It is
+// kept for existing callers. Both ends of a connection must use the same
+// format; a peer built before net/multiplex.Split moved to Session uses the
+// legacy format.
+//
+// Every connection of a Session starts with a preamble of magic bytes and a
+// version, which each end checks before reading anything else. A Session
+// whose peer speaks the legacy format, or another version of the Session
+// format, fails with ErrWireFormat or a *VersionError rather than
+// misreading its frames.
+package multiplex
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vsekhar/govtil/log"
+)
+
+// ErrKeepaliveTimeout is returned by every stream of a Session whose peer has
+// stopped answering keepalive pings.
+var ErrKeepaliveTimeout = errors.New("govtil/io/multiplex: keepalive timeout")
+
+// ErrFlowControl is returned by every stream of a Session whose peer sent
+// more data on a stream than its flow-control window allows.
+var ErrFlowControl = errors.New("govtil/io/multiplex: peer exceeded flow-control window")
+
+// ErrWireFormat is returned by every stream of a Session whose peer does not
+// start the connection with the Session preamble, e.g. because it speaks the
+// legacy format.
+var ErrWireFormat = errors.New("govtil/io/multiplex: peer does not speak the Session wire format (legacy multiplex peer?)")
+
+// VersionError is returned by every stream of a Session whose peer speaks
+// another version of the Session wire format.
+type VersionError struct {
+	Version byte // of the peer
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("govtil/io/multiplex: peer speaks Session wire format version %d, want %d", e.Version, wireVersion)
+}
+
+// The preamble that starts every connection of a Session.
+var magic = [4]byte{'G', 'V', 'M', 'X'}
+
+const wireVersion = 1
+
+func writePreamble(w io.Writer) error {
+	var b [len(magic) + 1]byte
+	copy(b[:], magic[:])
+	b[len(magic)] = wireVersion
+	_, err := w.Write(b[:])
+	return err
+}
+
+func readPreamble(r io.Reader) error {
+	var b [len(magic) + 1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(b[:len(magic)], magic[:]) {
+		return ErrWireFormat
+	}
+	if v := b[len(magic)]; v != wireVersion {
+		return &VersionError{v}
+	}
+	return nil
+}
+
+// ErrTimeout is returned by a stream operation whose deadline has passed. It
+// implements net.Error with Timeout() == true. The stream remains usable once
+// its deadline is extended.
+var ErrTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "govtil/io/multiplex: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type frameType uint8
+
+const (
+	frameData   frameType = iota // payload for a stream
+	frameClose                   // sender has closed a stream
+	frameWindow                  // sender has consumed N bytes of a stream
+	framePing                    // keepalive request, echoed back as a pong
+	framePong                    // keepalive response
+	frameOpen                    // sender has opened a new stream
+	frameAck                     // acknowledges frames up to Ack (resumable sessions)
+)
+
+// sequenced returns true for frames that must survive a reconnect of a
+// resumable session.
+func (t frameType) sequenced() bool {
+	switch t {
+	case frameData, frameClose, frameWindow, frameOpen:
+		return true
+	}
+	return false
+}
+
+// frame is the unit written to the underlying connection by a Session.
+//
+// Streams created with the session are numbered 0 to n-1 on both ends. Streams
+// opened later are numbered from n by whichever end opens them, so Opener is
+// needed to tell the two apart.
+type frame struct {
+	Type    frameType
+	Stream  uint
+	Opener  bool // Stream was opened by the sender of this frame
+	More    bool // Payload continues in the next data frame of the stream
+	N       int64
+	Payload []byte
+
+	// Used only by resumable sessions
+	Seq uint64 // sequence number of this frame
+	Ack uint64 // sequence number of the last frame received by the sender
+}
+
+// sid identifies a stream within a session.
+type sid struct {
+	id    uint
+	local bool // opened by this end
+}
+
+const (
+	// Each stream may have at most window bytes in flight before the sender
+	// blocks waiting for the receiver to read. This keeps a stream that is
+	// not being read from stalling the others (and keepalive frames).
+	window = 256 << 10
+
+	// Writes larger than maxFrame are split across several frames.
+	maxFrame = 32 << 10
+)
+
+// Options configures a Session.
+type Options struct {
+	// KeepaliveInterval is the time between PING frames. Zero disables
+	// keepalives.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveTimeout is how long to wait for a PONG before closing the
+	// session with ErrKeepaliveTimeout.
+	KeepaliveTimeout time.Duration
+
+	// Resumable sessions survive the loss of their connection. Each end
+	// buffers the frames the other has not acknowledged, and once a new
+	// connection is passed to Resume the streams continue where they left
+	// off. A keepalive timeout only drops the connection. Both ends must
+	// agree on Resumable.
+	Resumable bool
+
+	// ResumeTimeout is how long a resumable session waits for a new
+	// connection before failing. Zero means wait until the session is
+	// closed.
+	ResumeTimeout time.Duration
+
+	// MaxUnacked limits the payload bytes a resumable session buffers for
+	// the peer to acknowledge. Once it is reached, writers block until
+	// the peer catches up, their deadlines pass or the session fails. If
+	// zero, DefaultMaxUnacked is used.
+	MaxUnacked int
+}
+
+// DefaultMaxUnacked is used by resumable sessions whose Options do not set
+// MaxUnacked.
+const DefaultMaxUnacked = 4 << 20
+
+// DefaultOptions are used when NewSession is passed nil options.
+var DefaultOptions = Options{
+	KeepaliveInterval: 30 * time.Second,
+	KeepaliveTimeout:  60 * time.Second,
+}
+
+type wreq struct {
+	f    frame
+	done chan error
+}
+
+// transport is one connection carrying a session.
+type transport struct {
+	rwc  io.ReadWriteCloser
+	dead chan struct{}
+}
+
+func newTransport(rwc io.ReadWriteCloser) *transport {
+	return &transport{rwc, make(chan struct{})}
+}
+
+// attachment hands a new transport to the write pump, along with the last
+// frame the peer has received.
+type attachment struct {
+	tr  *transport
+	ack uint64
+}
+
+// Session multiplexes a number of streams over a single io.ReadWriteCloser.
+// Both ends of the connection must use a Session.
+type Session struct {
+	stats  counters
+	opened int64
+	closed int64
+
+	opts Options
+
+	wc      chan wreq  // frames waiting to be written
+	ctrl    chan frame // control frames, written ahead of wc
+	attachc chan attachment
+	die     chan struct{}
+
+	mu      sync.Mutex
+	tr      *transport // nil while a resumable session is disconnected
+	drops   int        // number of times the transport has been lost
+	streams map[sid]*Stream
+	initial []*Stream
+	open    int  // initial streams not yet closed
+	next    uint // number of the next stream opened by this end
+	err     error
+	rtt     time.Duration
+
+	accepts  chan *Stream // streams opened by the peer
+	adie     chan struct{}
+	acceptOK bool
+
+	pongs chan int64
+
+	// resumable sessions only, see resume.go
+	ready        chan struct{} // closed once token is known
+	token        Token
+	sendSeq      uint64        // last sequence number assigned
+	recvSeq      uint64        // last sequence number received
+	ackSent      uint64        // last recvSeq reported to the peer
+	unacked      []frame       // frames sent but not yet acknowledged
+	unackedBytes int           // payload bytes in unacked
+	ackc         chan struct{} // signalled when unacked frames are released
+}
+
+// backlog is the number of streams opened by the peer that may wait for
+// Accept before further ones are refused.
+const backlog = 64
+
+// NewSession starts a Session over rwc with n streams. When all n streams
+// have been Close()'d, the Session and rwc are also closed. If n is zero, the
+// Session lasts until it is closed explicitly or the connection fails. If opts
+// is nil, DefaultOptions are used.
+//
+// Further streams can be created with Open and received with Accept.
+func NewSession(rwc io.ReadWriteCloser, n uint, opts *Options) *Session {
+	s := newSession(n, opts)
+	if s.opts.Resumable {
+		go func() {
+			if err := s.handshake(rwc); err != nil {
+				log.Errorf("govtil/io/multiplex: handshake failed: %v", err)
+				rwc.Close()
+				s.fail(err)
+			}
+		}()
+	} else {
+		s.attach(newTransport(rwc), 0)
+	}
+	return s
+}
+
+// newSession creates a session with n streams and starts everything except
+// the transport.
+func newSession(n uint, opts *Options) *Session {
+	if opts == nil {
+		opts = &DefaultOptions
+	}
+	s := &Session{
+		opts:     *opts,
+		wc:       make(chan wreq),
+		ctrl:     make(chan frame, 64),
+		attachc:  make(chan attachment),
+		die:      make(chan struct{}),
+		ready:    make(chan struct{}),
+		streams:  make(map[sid]*Stream),
+		open:     int(n),
+		next:     n,
+		accepts:  make(chan *Stream, backlog),
+		adie:     make(chan struct{}),
+		acceptOK: true,
+		pongs:    make(chan int64, 1),
+		ackc:     make(chan struct{}, 1),
+	}
+	if s.opts.MaxUnacked == 0 {
+		s.opts.MaxUnacked = DefaultMaxUnacked
+	}
+	for i := uint(0); i < n; i++ {
+		st := newStream(s, sid{i, false})
+		s.streams[st.sid] = st
+		s.initial = append(s.initial, st)
+	}
+	s.opened = int64(n)
+	go s.wpump()
+	if s.opts.KeepaliveInterval > 0 {
+		go s.keepalive()
+	}
+	return s
+}
+
+// attach starts using tr. ack is the last frame the peer has received.
+func (s *Session) attach(tr *transport, ack uint64) {
+	s.mu.Lock()
+	s.tr = tr
+	s.mu.Unlock()
+	select {
+	case s.attachc <- attachment{tr, ack}:
+	case <-s.die:
+		return
+	}
+	go s.rpump(tr)
+}
+
+// transport returns the current transport, or nil if there is none.
+func (s *Session) transport() *transport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tr
+}
+
+// drop abandons tr after err. A resumable session waits for Resume, any
+// other session fails.
+func (s *Session) drop(tr *transport, err error) {
+	if !s.opts.Resumable {
+		s.fail(err)
+		return
+	}
+	s.mu.Lock()
+	if tr == nil || s.tr != tr {
+		s.mu.Unlock()
+		return
+	}
+	s.tr = nil
+	s.drops++
+	drops := s.drops
+	s.mu.Unlock()
+	close(tr.dead)
+	tr.rwc.Close()
+
+	if s.Err() != nil {
+		return
+	}
+	log.Printf("govtil/io/multiplex: session %v lost connection: %v", s.token, err)
+	if s.opts.ResumeTimeout > 0 {
+		time.AfterFunc(s.opts.ResumeTimeout, func() {
+			s.mu.Lock()
+			expired := s.tr == nil && s.drops == drops
+			s.mu.Unlock()
+			if expired {
+				log.Errorf("govtil/io/multiplex: session %v not resumed within %v", s.token, s.opts.ResumeTimeout)
+				s.fail(err)
+			}
+		})
+	}
+}
+
+// Streams returns the streams the session was created with, in order.
+func (s *Session) Streams() []*Stream {
+	return append([]*Stream(nil), s.initial...)
+}
+
+// Open creates a new stream. The peer receives it from Accept.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	st := newStream(s, sid{s.next, true})
+	s.next++
+	s.streams[st.sid] = st
+	s.mu.Unlock()
+	atomic.AddInt64(&s.opened, 1)
+
+	if err := s.write(st.frame(frameOpen), time.Time{}, nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for and returns the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.adie:
+		return nil, io.ErrClosedPipe
+	case <-s.die:
+		return nil, s.Err()
+	}
+}
+
+// CloseAccept stops accepting streams opened by the peer. Blocked and future
+// calls to Accept return io.ErrClosedPipe and new streams are refused. Streams
+// already accepted are unaffected.
+func (s *Session) CloseAccept() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.acceptOK {
+		s.acceptOK = false
+		close(s.adie)
+	}
+	return nil
+}
+
+// accept registers a stream opened by the peer and queues it for Accept.
+func (s *Session) accept(id uint) {
+	st := newStream(s, sid{id, false})
+	s.mu.Lock()
+	ok := s.acceptOK && s.err == nil
+	if ok {
+		s.streams[st.sid] = st
+		select {
+		case s.accepts <- st:
+		default:
+			delete(s.streams, st.sid)
+			ok = false
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		log.Debugf("govtil/io/multiplex: refusing stream %v", id)
+		s.post(st.frame(frameClose))
+		return
+	}
+	atomic.AddInt64(&s.opened, 1)
+}
+
+// RTT returns the most recently measured keepalive round-trip time, or zero
+// if none has been measured yet.
+func (s *Session) RTT() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rtt
+}
+
+// Done returns a channel that is closed when the session is finished.
+func (s *Session) Done() <-chan struct{} {
+	return s.die
+}
+
+// Disconnected returns a channel that is closed when the session loses its
+// current connection. It is already closed if the session has no connection.
+func (s *Session) Disconnected() <-chan struct{} {
+	if tr := s.transport(); tr != nil {
+		return tr.dead
+	}
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+// Err returns the error that terminated the session, or nil if it is still
+// running.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close closes the session, all of its streams and the underlying
+// io.ReadWriteCloser.
+func (s *Session) Close() error {
+	return s.fail(io.ErrClosedPipe)
+}
+
+// fail terminates the session, making err visible to every stream. Only the
+// first call has any effect.
+func (s *Session) fail(err error) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.err = err
+	close(s.die)
+	tr := s.tr
+	s.tr = nil
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, st := range s.streams {
+		streams = append(streams, st)
+	}
+	s.mu.Unlock()
+
+	for _, st := range streams {
+		st.fail(err)
+	}
+	if tr == nil {
+		return nil
+	}
+	close(tr.dead)
+	return tr.rwc.Close()
+}
+
+// write queues f and waits for it to be written to the underlying connection.
+// If deadline passes before f is queued, write returns ErrTimeout. A zero
+// deadline means no deadline. Time spent waiting to be queued is added to
+// the blocked counter of the session and, if not nil, of c.
+func (s *Session) write(f frame, deadline time.Time, c *counters) error {
+	r := wreq{f, make(chan error, 1)}
+	t, stop := timer(deadline)
+	defer stop()
+	start := time.Now()
+	select {
+	case s.wc <- r:
+		s.block(c, time.Since(start))
+	case <-t:
+		s.block(c, time.Since(start))
+		return ErrTimeout
+	case <-s.die:
+		return s.Err()
+	}
+	select {
+	case err := <-r.done:
+		return err
+	case <-s.die:
+		return s.Err()
+	}
+}
+
+func (s *Session) block(c *counters, d time.Duration) {
+	atomic.AddInt64(&s.stats.blocked, int64(d))
+	if c != nil {
+		atomic.AddInt64(&c.blocked, int64(d))
+	}
+}
+
+// post queues a control frame without waiting for it to be written.
+func (s *Session) post(f frame) {
+	select {
+	case s.ctrl <- f:
+	case <-s.die:
+	}
+}
+
+// wpump writes frames to the current transport. It runs for the lifetime of
+// the session, waiting for a new transport whenever one is lost.
+func (s *Session) wpump() {
+	var tr *transport
+	var enc *gob.Encoder
+	for {
+		if tr == nil {
+			select {
+			case a := <-s.attachc:
+				tr = a.tr
+				enc = gob.NewEncoder(tr.rwc)
+				var err error
+				if !s.opts.Resumable {
+					// resumable transports start with the preamble in their hello
+					err = writePreamble(tr.rwc)
+				}
+				if err == nil {
+					err = s.resend(enc, a.ack)
+				}
+				if err != nil {
+					s.drop(tr, err)
+					tr = nil
+				}
+			case <-s.die:
+				return
+			}
+			continue
+		}
+
+		// data waits while too much is unacknowledged; control frames
+		// carry the acks and must keep flowing
+		wc := s.wc
+		if s.unackedFull() {
+			wc = nil
+		}
+		var err error
+		select {
+		case f := <-s.ctrl:
+			err = s.encode(enc, &f)
+		default:
+			select {
+			case f := <-s.ctrl:
+				err = s.encode(enc, &f)
+			case <-s.ackc:
+				continue
+			case r := <-wc:
+				err = s.encode(enc, &r.f)
+				if err == nil {
+					atomic.AddInt64(&s.stats.bytesOut, int64(len(r.f.Payload)))
+				}
+				if s.opts.Resumable && r.f.Type.sequenced() {
+					r.done <- nil // buffered, will be resent
+				} else {
+					r.done <- err
+				}
+			case <-tr.dead:
+				tr = nil
+				continue
+			case <-s.die:
+				return
+			}
+		}
+		if err != nil {
+			if s.Err() == nil {
+				log.Errorf("govtil/io/multiplex: wpump error: %v", err)
+			}
+			s.drop(tr, err)
+			tr = nil
+			continue
+		}
+		atomic.AddInt64(&s.stats.framesOut, 1)
+	}
+}
+
+// rpump reads frames from tr until it fails.
+func (s *Session) rpump(tr *transport) {
+	if !s.opts.Resumable {
+		if err := readPreamble(tr.rwc); err != nil {
+			if s.Err() == nil {
+				log.Errorf("govtil/io/multiplex: rpump error: %v", err)
+			}
+			s.drop(tr, err)
+			return
+		}
+	}
+	dec := gob.NewDecoder(tr.rwc)
+	for {
+		var f frame
+		if err := dec.Decode(&f); err != nil {
+			if err != io.EOF && s.Err() == nil && s.transport() == tr {
+				log.Errorf("govtil/io/multiplex: rpump error: %v", err)
+			}
+			s.drop(tr, err)
+			return
+		}
+		select {
+		case <-tr.dead:
+			return // replaced by a newer transport
+		default:
+		}
+		atomic.AddInt64(&s.stats.framesIn, 1)
+		atomic.AddInt64(&s.stats.bytesIn, int64(len(f.Payload)))
+		if s.opts.Resumable && !s.received(&f) {
+			continue
+		}
+
+		switch f.Type {
+		case frameAck:
+			continue
+		case framePing:
+			select {
+			case s.ctrl <- frame{Type: framePong, N: f.N}:
+			default:
+				// write side is backed up, peer will ping again
+			}
+			continue
+		case framePong:
+			select {
+			case s.pongs <- f.N:
+			default:
+			}
+			continue
+		}
+
+		if f.Type == frameOpen {
+			s.accept(f.Stream)
+			continue
+		}
+
+		key := sid{f.Stream, false}
+		if f.Stream >= uint(len(s.initial)) {
+			key.local = !f.Opener
+		}
+		s.mu.Lock()
+		st, ok := s.streams[key]
+		s.mu.Unlock()
+		if !ok {
+			if f.Type == frameData {
+				atomic.AddInt64(&s.stats.dropped, 1)
+			}
+			log.Debugf("govtil/io/multiplex: frame for unknown channel %v, dumping payload of len %v", f.Stream, len(f.Payload))
+			continue
+		}
+		switch f.Type {
+		case frameData:
+			ok, err := st.push(f.Payload, f.More)
+			if err != nil {
+				log.Errorf("govtil/io/multiplex: stream %v: %v", f.Stream, err)
+				s.fail(err)
+				return
+			}
+			if !ok {
+				atomic.AddInt64(&s.stats.dropped, 1)
+				log.Debugf("govtil/io/multiplex: sub-channel closed, dumping payload of len %v", len(f.Payload))
+			}
+		case frameWindow:
+			st.grow(f.N)
+		case frameClose:
+			st.remoteClose()
+		}
+	}
+}
+
+func (s *Session) keepalive() {
+	for {
+		select {
+		case <-time.After(s.opts.KeepaliveInterval):
+		case <-s.die:
+			return
+		}
+
+		tr := s.transport()
+		if tr == nil {
+			continue // waiting to resume
+		}
+		sent := time.Now()
+		s.post(frame{Type: framePing, N: sent.UnixNano()})
+		t := time.NewTimer(s.opts.KeepaliveTimeout)
+		ok := s.awaitPong(sent, t.C)
+		t.Stop()
+		if ok {
+			continue
+		}
+		if !s.opts.Resumable || s.Err() != nil {
+			return
+		}
+		s.drop(tr, ErrKeepaliveTimeout)
+	}
+}
+
+// awaitPong waits for the response to the ping sent at time sent and records
+// the round-trip time. It returns false if no response arrived in time or the
+// session is finished.
+func (s *Session) awaitPong(sent time.Time, timeout <-chan time.Time) bool {
+	for {
+		select {
+		case n := <-s.pongs:
+			if n != sent.UnixNano() {
+				continue // stale pong
+			}
+			s.mu.Lock()
+			s.rtt = time.Since(sent)
+			s.mu.Unlock()
+			return true
+		case <-timeout:
+			log.Errorf("govtil/io/multiplex: no keepalive response in %v, closing connection", s.opts.KeepaliveTimeout)
+			if !s.opts.Resumable {
+				s.fail(ErrKeepaliveTimeout)
+			}
+			return false
+		case <-s.die:
+			return false
+		}
+	}
+}
+
+// streamClosed is called once for each stream that is closed locally.
+func (s *Session) streamClosed(st *Stream) {
+	atomic.AddInt64(&s.closed, 1)
+	s.mu.Lock()
+	delete(s.streams, st.sid)
+	if st.id < uint(len(s.initial)) {
+		s.open--
+	}
+	done := s.open == 0 && len(s.initial) > 0
+	s.mu.Unlock()
+	if done {
+		s.Close()
+	}
+}
+
+// Stream is one logical channel of a Session. It implements
+// io.ReadWriteCloser.
+type Stream struct {
+	stats counters
+
+	s *Session
+	sid
+
+	rmu sync.Mutex // serializes readers
+	wmu sync.Mutex // serializes writers, so messages are not interleaved
+
+	mu       sync.Mutex
+	rq       []chunk // received payloads not yet read
+	queued   int64   // bytes in rq
+	consumed int64   // bytes read but not yet reported to the peer
+	window   int64   // bytes we may send before the peer reports consumption
+	rerr     error
+	werr     error
+	closed   bool
+
+	rdeadline time.Time
+	wdeadline time.Time
+
+	rnotify chan struct{}
+	wnotify chan struct{}
+}
+
+// chunk is the payload of a data frame.
+type chunk struct {
+	p    []byte
+	more bool
+}
+
+func newStream(s *Session, id sid) *Stream {
+	return &Stream{
+		s:       s,
+		sid:     id,
+		window:  window,
+		rnotify: make(chan struct{}, 1),
+		wnotify: make(chan struct{}, 1),
+	}
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// timer returns a channel that fires at deadline, or never if deadline is
+// zero, and a function to release it.
+func timer(deadline time.Time) (<-chan time.Time, func() bool) {
+	if deadline.IsZero() {
+		return nil, func() bool { return false }
+	}
+	t := time.NewTimer(time.Until(deadline))
+	return t.C, t.Stop
+}
+
+// wait blocks until c is notified or deadline passes.
+func wait(c chan struct{}, deadline time.Time) {
+	t, stop := timer(deadline)
+	defer stop()
+	select {
+	case <-c:
+	case <-t:
+	}
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// ID returns the stream's number within its session. Streams opened by
+// either end are numbered independently, see Local.
+func (st *Stream) ID() uint {
+	return st.id
+}
+
+// Local returns true if the stream was created by this end with Open.
+func (st *Stream) Local() bool {
+	return st.local
+}
+
+func (st *Stream) frame(t frameType) frame {
+	return frame{Type: t, Stream: st.id, Opener: st.local}
+}
+
+func (st *Stream) Read(d []byte) (int, error) {
+	st.rmu.Lock()
+	defer st.rmu.Unlock()
+	for {
+		if err := st.lockData(); err != nil {
+			return 0, err
+		}
+		n := 0
+		for len(st.rq) > 0 && n < len(d) {
+			c := &st.rq[0]
+			k := copy(d[n:], c.p)
+			n += k
+			c.p = c.p[k:]
+			if len(c.p) == 0 {
+				st.rq = st.rq[1:]
+			}
+		}
+		st.consume(n)
+		if n > 0 || len(d) == 0 {
+			return n, nil
+		}
+		// only empty messages were queued, wait for more
+	}
+}
+
+// lockData waits until data is queued or the stream has failed. If it returns
+// nil, st.mu is held and must be released with consume.
+func (st *Stream) lockData() error {
+	for {
+		st.mu.Lock()
+		if st.rerr == nil && expired(st.rdeadline) {
+			st.mu.Unlock()
+			return ErrTimeout
+		}
+		if len(st.rq) > 0 {
+			return nil
+		}
+		if st.rerr != nil {
+			err := st.rerr
+			st.mu.Unlock()
+			return err
+		}
+		deadline := st.rdeadline
+		st.mu.Unlock()
+		wait(st.rnotify, deadline)
+	}
+}
+
+// consume records that n bytes have been taken from rq and releases st.mu.
+// The peer is told once enough of its send window has been consumed.
+func (st *Stream) consume(n int) {
+	st.consumed += int64(n)
+	st.queued -= int64(n)
+	var update int64
+	if st.consumed >= window/2 && st.rerr == nil {
+		update = st.consumed
+		st.consumed = 0
+	}
+	st.mu.Unlock()
+	if update > 0 {
+		f := st.frame(frameWindow)
+		f.N = update
+		st.s.post(f)
+	}
+}
+
+func (st *Stream) Write(d []byte) (int, error) {
+	return st.send(d, false)
+}
+
+// send writes d in as many frames as needed. If msg is true, the frames are
+// marked as a single message, which may be empty.
+func (st *Stream) send(d []byte, msg bool) (n int, err error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+	empty := msg && len(d) == 0
+	for len(d) > 0 || empty {
+		empty = false
+		k, deadline, err := st.reserve(len(d))
+		if err != nil {
+			return n, err
+		}
+		f := st.frame(frameData)
+		f.Payload = d[:k]
+		f.More = msg && k < len(d)
+		if err = st.s.write(f, deadline, &st.stats); err != nil {
+			if err == ErrTimeout {
+				st.grow(int64(k)) // never sent
+			}
+			return n, err
+		}
+		atomic.AddInt64(&st.stats.framesOut, 1)
+		atomic.AddInt64(&st.stats.bytesOut, int64(k))
+		n += k
+		d = d[k:]
+	}
+	return n, nil
+}
+
+// reserve waits until some of the send window is available and claims up to
+// want bytes of it. It also returns the current write deadline.
+func (st *Stream) reserve(want int) (int, time.Time, error) {
+	for {
+		st.mu.Lock()
+		if st.werr != nil {
+			err := st.werr
+			st.mu.Unlock()
+			return 0, time.Time{}, err
+		}
+		if expired(st.wdeadline) {
+			st.mu.Unlock()
+			return 0, time.Time{}, ErrTimeout
+		}
+		if st.window > 0 || want == 0 {
+			k := int64(want)
+			if k > st.window {
+				k = st.window
+			}
+			if k > maxFrame {
+				k = maxFrame
+			}
+			st.window -= k
+			deadline := st.wdeadline
+			st.mu.Unlock()
+			return int(k), deadline, nil
+		}
+		deadline := st.wdeadline
+		st.mu.Unlock()
+		start := time.Now()
+		wait(st.wnotify, deadline)
+		st.s.block(&st.stats, time.Since(start))
+	}
+}
+
+// SetDeadline sets both the read and write deadlines of the stream.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline sets the time after which Read returns ErrTimeout. A zero
+// value disables the deadline.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rdeadline = t
+	st.mu.Unlock()
+	notify(st.rnotify)
+	return nil
+}
+
+// SetWriteDeadline sets the time after which Write returns ErrTimeout. A zero
+// value disables the deadline. Data already handed to the session when the
+// deadline passes is still delivered.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.wdeadline = t
+	st.mu.Unlock()
+	notify(st.wnotify)
+	return nil
+}
+
+// Close closes the stream in both directions. The peer will read io.EOF once
+// it has consumed any data already sent.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.rq = nil
+	st.queued = 0
+	st.rerr = io.ErrClosedPipe
+	st.werr = io.ErrClosedPipe
+	st.mu.Unlock()
+	notify(st.rnotify)
+	notify(st.wnotify)
+
+	if st.s.Err() == nil {
+		st.s.write(st.frame(frameClose), time.Time{}, nil)
+	}
+	st.s.streamClosed(st)
+	return nil
+}
+
+// push queues a received payload, returning false if the stream is closed.
+// It returns ErrFlowControl if the peer has sent more than the window allows,
+// i.e. more than window bytes that have not been reported consumed.
+func (st *Stream) push(p []byte, more bool) (bool, error) {
+	st.mu.Lock()
+	if st.queued+st.consumed+int64(len(p)) > window {
+		st.mu.Unlock()
+		return false, ErrFlowControl
+	}
+	if st.closed || st.rerr != nil {
+		st.mu.Unlock()
+		atomic.AddInt64(&st.stats.dropped, 1)
+		return false, nil
+	}
+	st.rq = append(st.rq, chunk{p, more})
+	st.queued += int64(len(p))
+	st.mu.Unlock()
+	atomic.AddInt64(&st.stats.framesIn, 1)
+	atomic.AddInt64(&st.stats.bytesIn, int64(len(p)))
+	notify(st.rnotify)
+	return true, nil
+}
+
+func (st *Stream) grow(n int64) {
+	st.mu.Lock()
+	st.window += n
+	st.mu.Unlock()
+	notify(st.wnotify)
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	if st.rerr == nil {
+		st.rerr = io.EOF
+	}
+	if st.werr == nil {
+		st.werr = io.ErrClosedPipe
+	}
+	st.mu.Unlock()
+	notify(st.rnotify)
+	notify(st.wnotify)
+}
+
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	if st.rerr == nil {
+		st.rerr = err
+	}
+	if st.werr == nil {
+		st.werr = err
+	}
+	st.mu.Unlock()
+	notify(st.rnotify)
+	notify(st.wnotify)
+}
@@ -0,0 +1,270 @@
+package multiplex
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	vio "github.com/vsekhar/govtil/io"
+)
+
+func sessionPair(n uint, opts *Options) (*Session, *Session) {
+	a0, a1 := io.Pipe()
+	b0, b1 := io.Pipe()
+	s0 := NewSession(vio.NewReadWriteCloser(a0, b1), n, opts)
+	s1 := NewSession(vio.NewReadWriteCloser(b0, a1), n, opts)
+	return s0, s1
+}
+
+func rwcs(s *Session) []io.ReadWriteCloser {
+	var r []io.ReadWriteCloser
+	for _, st := range s.Streams() {
+		r = append(r, st)
+	}
+	return r
+}
+
+func TestSessionBiDirectional(t *testing.T) {
+	s0, s1 := sessionPair(2, nil)
+	DoTestBiDirectional(t, rwcs(s0), rwcs(s1))
+}
+
+func TestSessionFlowControl(t *testing.T) {
+	s0, s1 := sessionPair(2, nil)
+	big := bytes.Repeat([]byte("0123456789"), window/2)
+	done := make(chan error)
+	go func() {
+		_, err := s0.Streams()[0].Write(big)
+		done <- err
+	}()
+
+	// stream 1 must not be blocked behind unread data on stream 0
+	go s0.Streams()[1].Write(msg1)
+	r := make([]byte, len(msg1))
+	if _, err := io.ReadFull(s1.Streams()[1], r); err != nil {
+		t.Fatalf("failed to read stream 1: %v", err)
+	}
+	if !bytes.Equal(r, msg1) {
+		t.Fatalf("bytes not equal: expected '%v', got '%v'", msg1, r)
+	}
+
+	r = make([]byte, len(big))
+	if _, err := io.ReadFull(s1.Streams()[0], r); err != nil {
+		t.Fatalf("failed to read stream 0: %v", err)
+	}
+	if !bytes.Equal(r, big) {
+		t.Fatalf("large payload corrupted")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+}
+
+func TestSessionWindowEnforced(t *testing.T) {
+	a0, a1 := io.Pipe()
+	b0, b1 := io.Pipe()
+	s0 := NewSession(vio.NewReadWriteCloser(a0, b1), 1, nil)
+	defer s0.Close()
+	go io.Copy(ioutil.Discard, b0)
+
+	// a peer that ignores the window and never waits for updates
+	go func() {
+		if writePreamble(a1) != nil {
+			return
+		}
+		enc := gob.NewEncoder(a1)
+		p := make([]byte, maxFrame)
+		for i := 0; i <= window/maxFrame; i++ {
+			if enc.Encode(&frame{Type: frameData, Payload: p}) != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-s0.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session accepted data beyond the window")
+	}
+	if err := s0.Err(); err != ErrFlowControl {
+		t.Errorf("expected %v, got %v", ErrFlowControl, err)
+	}
+}
+
+func TestSessionWireFormat(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		peer func(io.WriteCloser)
+		err  string
+	}{
+		{"legacy", func(w io.WriteCloser) {
+			SplitWriteCloser(w, 1)[0].Write([]byte("hello"))
+		}, ErrWireFormat.Error()},
+		{"version", func(w io.WriteCloser) {
+			w.Write(append(magic[:], wireVersion+1))
+		}, (&VersionError{wireVersion + 1}).Error()},
+	} {
+		a0, a1 := io.Pipe()
+		b0, b1 := io.Pipe()
+		s0 := NewSession(vio.NewReadWriteCloser(a0, b1), 1, nil)
+		go io.Copy(ioutil.Discard, b0)
+		go c.peer(a1)
+		select {
+		case <-s0.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: session did not fail", c.name)
+		}
+		if err := s0.Err(); err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected %q, got %v", c.name, c.err, err)
+		}
+		s0.Close()
+		a1.Close()
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	s0, s1 := sessionPair(1, nil)
+	st0, st1 := s0.Streams()[0], s1.Streams()[0]
+	go func() {
+		st0.Write(msg0)
+		st0.Close()
+	}()
+	d, err := ioutil.ReadAll(st1)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(d, msg0) {
+		t.Fatalf("bytes not equal: expected '%v', got '%v'", msg0, d)
+	}
+	if _, err := st1.Write(msg1); err == nil {
+		t.Errorf("expected error writing to stream closed by peer")
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	opts := &Options{
+		KeepaliveInterval: 10 * time.Millisecond,
+		KeepaliveTimeout:  time.Second,
+	}
+	s0, s1 := sessionPair(1, opts)
+	defer s0.Close()
+	defer s1.Close()
+	for i := 0; i < 100 && s0.RTT() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s0.RTT() == 0 {
+		t.Fatalf("no round-trip time measured")
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	a0, a1 := io.Pipe()
+	b0, b1 := io.Pipe()
+	go io.Copy(ioutil.Discard, b0) // a peer that never answers
+	s := NewSession(vio.NewReadWriteCloser(a0, b1), 1, &Options{
+		KeepaliveInterval: 10 * time.Millisecond,
+		KeepaliveTimeout:  20 * time.Millisecond,
+	})
+	defer a1.Close()
+
+	if _, err := s.Streams()[0].Read(make([]byte, 10)); err != ErrKeepaliveTimeout {
+		t.Fatalf("expected %v, got %v", ErrKeepaliveTimeout, err)
+	}
+	if s.Err() != ErrKeepaliveTimeout {
+		t.Errorf("expected session error %v, got %v", ErrKeepaliveTimeout, s.Err())
+	}
+}
+
+func TestSessionOpenAccept(t *testing.T) {
+	s0, s1 := sessionPair(1, nil)
+	defer s0.Close()
+	defer s1.Close()
+
+	st0, err := s0.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	st1, err := s1.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if st0.ID() != st1.ID() || !st0.Local() || st1.Local() {
+		t.Errorf("mismatched streams %v/%v and %v/%v", st0.ID(), st0.Local(), st1.ID(), st1.Local())
+	}
+	DoTestBiDirectional(t, []io.ReadWriteCloser{st0, s0.Streams()[0]}, []io.ReadWriteCloser{st1, s1.Streams()[0]})
+
+	// streams opened after CloseAccept are refused
+	s1.CloseAccept()
+	if _, err := s1.Accept(); err != io.ErrClosedPipe {
+		t.Errorf("expected %v, got %v", io.ErrClosedPipe, err)
+	}
+	st, err := s0.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := st.Read(make([]byte, 10)); err != io.EOF {
+		t.Errorf("expected %v from refused stream, got %v", io.EOF, err)
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	s0, s1 := sessionPair(2, nil)
+	defer s0.Close()
+	defer s1.Close()
+
+	st0, st1 := s0.Streams()[0], s1.Streams()[0]
+	if _, err := st0.Write(msg0); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := st0.Write(msg1); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	for i := 0; i < 100 && st1.Stats().Queued < int64(len(msg0)+len(msg1)); i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	n := int64(len(msg0) + len(msg1))
+	if st := st0.Stats(); st.BytesOut != n || st.FramesOut != 2 {
+		t.Errorf("bad sender stats %+v", st)
+	}
+	if st := st1.Stats(); st.BytesIn != n || st.FramesIn != 2 || st.Queued != n {
+		t.Errorf("bad receiver stats %+v", st)
+	}
+	st1.Read(make([]byte, len(msg0)))
+	if q := s1.Stats().Queued; q != int64(len(msg1)) {
+		t.Errorf("expected %d bytes queued, got %d", len(msg1), q)
+	}
+
+	// payloads for a stream closed on the receiving end are dropped
+	s1.Streams()[1].Close()
+	s0.write(frame{Type: frameData, Stream: 1, Payload: msg0}, time.Time{}, nil)
+	for i := 0; i < 100 && s1.Stats().Dropped == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	ss := s1.Stats()
+	if ss.Dropped != 1 || ss.StreamsOpened != 2 || ss.StreamsClosed != 1 {
+		t.Errorf("bad session stats %+v", ss)
+	}
+
+	var buf bytes.Buffer
+	if err := s1.Varz(&buf); err != nil {
+		t.Fatalf("Varz: %v", err)
+	}
+	for _, k := range []string{"Dropped=1\n", "StreamsClosed=1\n", "stream[0].BytesIn=12\n"} {
+		if !bytes.Contains(buf.Bytes(), []byte(k)) {
+			t.Errorf("varz missing '%s' in:\n%s", k, buf.Bytes())
+		}
+	}
+	if err := s1.Varz(failWriter{}); err != errFailWrite {
+		t.Errorf("Varz to failing writer: got %v", err)
+	}
+}
+
+var errFailWrite = errors.New("write failed")
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, errFailWrite }
@@ -0,0 +1,149 @@
+package multiplex
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds traffic counters for a stream or a whole session.
+type Stats struct {
+	BytesIn   int64         // payload bytes received
+	BytesOut  int64         // payload bytes sent
+	FramesIn  int64         // frames received
+	FramesOut int64         // frames sent
+	Queued    int64         // bytes received but not yet read
+	Blocked   time.Duration // time writers spent waiting for the peer or the connection
+	Dropped   int64         // payloads discarded because their stream was closed
+}
+
+// SessionStats holds the totals for a session, including streams that have
+// since been closed.
+type SessionStats struct {
+	Stats
+	StreamsOpened int64
+	StreamsClosed int64
+}
+
+// counters are updated atomically and are kept at the start of their
+// containing structs for alignment.
+type counters struct {
+	bytesIn   int64
+	bytesOut  int64
+	framesIn  int64
+	framesOut int64
+	blocked   int64
+	dropped   int64
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		BytesIn:   atomic.LoadInt64(&c.bytesIn),
+		BytesOut:  atomic.LoadInt64(&c.bytesOut),
+		FramesIn:  atomic.LoadInt64(&c.framesIn),
+		FramesOut: atomic.LoadInt64(&c.framesOut),
+		Blocked:   time.Duration(atomic.LoadInt64(&c.blocked)),
+		Dropped:   atomic.LoadInt64(&c.dropped),
+	}
+}
+
+// Stats returns the counters for the stream.
+func (st *Stream) Stats() Stats {
+	r := st.stats.snapshot()
+	st.mu.Lock()
+	r.Queued = st.queued
+	st.mu.Unlock()
+	return r
+}
+
+// Stats returns the counters for the session. Queued covers the streams that
+// are still open.
+func (s *Session) Stats() SessionStats {
+	r := SessionStats{
+		Stats:         s.stats.snapshot(),
+		StreamsOpened: atomic.LoadInt64(&s.opened),
+		StreamsClosed: atomic.LoadInt64(&s.closed),
+	}
+	for _, st := range s.live() {
+		r.Queued += st.Stats().Queued
+	}
+	return r
+}
+
+// live returns the open streams of the session, ordered by number.
+func (s *Session) live() []*Stream {
+	s.mu.Lock()
+	r := make([]*Stream, 0, len(s.streams))
+	for _, st := range s.streams {
+		r = append(r, st)
+	}
+	s.mu.Unlock()
+	sort.Sort(byID(r))
+	return r
+}
+
+type byID []*Stream
+
+func (b byID) Len() int      { return len(b) }
+func (b byID) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byID) Less(i, j int) bool {
+	if b[i].id != b[j].id {
+		return b[i].id < b[j].id
+	}
+	return !b[i].local
+}
+
+// name identifies a stream in varz output: streams the session was created
+// with by number, others by number prefixed with L or R for the end that
+// opened them.
+func (st *Stream) name() string {
+	switch {
+	case st.local:
+		return fmt.Sprintf("L%d", st.id)
+	case st.id < uint(len(st.s.initial)):
+		return fmt.Sprint(st.id)
+	}
+	return fmt.Sprintf("R%d", st.id)
+}
+
+func writeStats(prefix string, st Stats, w io.Writer) error {
+	for _, kv := range []struct {
+		k string
+		v interface{}
+	}{
+		{"Blocked", st.Blocked},
+		{"BytesIn", st.BytesIn},
+		{"BytesOut", st.BytesOut},
+		{"Dropped", st.Dropped},
+		{"FramesIn", st.FramesIn},
+		{"FramesOut", st.FramesOut},
+		{"Queued", st.Queued},
+	} {
+		if _, err := fmt.Fprintf(w, "%s%s=%v\n", prefix, kv.k, kv.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Varz writes the session and per-stream counters. It is a varz function for
+// govtil/net/server/varz, e.g.
+//
+//	server.Varz.Register(session.Varz, "mux")
+func (s *Session) Varz(w io.Writer) error {
+	ss := s.Stats()
+	if err := writeStats("", ss.Stats, w); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "StreamsOpened=%d\nStreamsClosed=%d\n", ss.StreamsOpened, ss.StreamsClosed); err != nil {
+		return err
+	}
+	for _, st := range s.live() {
+		if err := writeStats("stream["+st.name()+"].", st.Stats(), w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -39,6 +39,8 @@ func (p *wproxy) Close() error {
 
 // Split a WriteCloser into 'n' WriteClosers. When all returned WriteClosers
 // have been Close()'d, then the underlying ReadCloser is also closed.
+//
+// This writes the legacy wire format, which is not compatible with Session.
 func SplitWriteCloser(wc io.WriteCloser, n uint) []io.WriteCloser {
 	var r []io.WriteCloser
 	c := make(chan wop)
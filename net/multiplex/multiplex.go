@@ -1,21 +1,64 @@
+// Package multiplex splits a net.Conn into several net.Conn's.
+//
+// Connections are carried by a govtil/io/multiplex Session, with keepalives
+// and flow control. Earlier versions of Split used the legacy framing of
+// io/multiplex.SplitReadWriteCloser; the two formats are incompatible, so
+// both ends of a connection must be built with the same version of this
+// package. Sessions check a versioned preamble at the start of each
+// connection, so a connection from a peer using the legacy format fails with
+// io/multiplex.ErrWireFormat instead of misreading its frames.
 package multiplex
 
 import (
-	"errors"
-	"io"
+	"fmt"
 	"net"
-	"time"
 
 	viomux "github.com/vsekhar/govtil/io/multiplex"
 )
 
-// muxConn implements net.Conn
+// Addr is the address of one end of a multiplexed stream.
+type Addr struct {
+	Conn   net.Addr // address of the underlying connection
+	Stream uint     // stream number within the session
+	Local  bool     // stream was opened by the local end of the session
+}
+
+func (a *Addr) Network() string {
+	return "mux+" + a.Conn.Network()
+}
+
+func (a *Addr) String() string {
+	by := "remote"
+	if a.Local {
+		by = "local"
+	}
+	return fmt.Sprintf("%s/%s/%d", a.Conn, by, a.Stream)
+}
+
+// MessageConn is a net.Conn that can also send and receive whole messages.
+// All net.Conn's returned by this package are MessageConn's.
+type MessageConn interface {
+	net.Conn
+	SendMsg([]byte) error
+	RecvMsg() ([]byte, error)
+}
+
+// muxConn implements MessageConn. Deadlines are provided by the underlying
+// stream and apply to that stream only.
 type muxConn struct {
-	io.ReadWriteCloser
+	*viomux.Stream
 	laddr net.Addr
 	raddr net.Addr
 }
 
+func newMuxConn(st *viomux.Stream, laddr, raddr net.Addr) *muxConn {
+	return &muxConn{
+		st,
+		&Addr{laddr, st.ID(), st.Local()},
+		&Addr{raddr, st.ID(), st.Local()},
+	}
+}
+
 func (mx *muxConn) LocalAddr() net.Addr {
 	return mx.laddr
 }
@@ -24,25 +67,85 @@ func (mx *muxConn) RemoteAddr() net.Addr {
 	return mx.raddr
 }
 
-func (*muxConn) SetDeadline(time.Time) error {
-	return errors.New("muxConn does not implement deadlines")
+// Session is a multiplexed net.Conn. It sends keepalive pings according to
+// its options and exposes the measured round-trip time via RTT().
+type Session struct {
+	*viomux.Session
+	conns []net.Conn
+	laddr net.Addr
+	raddr net.Addr
+}
+
+// NewSession splits c into n net.Conn's using a multiplexed session with the
+// given options. If opts is nil, viomux.DefaultOptions are used.
+func NewSession(c net.Conn, n uint, opts *viomux.Options) *Session {
+	return wrap(viomux.NewSession(c, n, opts), c)
 }
 
-func (*muxConn) SetReadDeadline(time.Time) error {
-	return errors.New("muxConn does not implement deadlines")
+// wrap returns the Session for vs, which is running over c.
+func wrap(vs *viomux.Session, c net.Conn) *Session {
+	s := &Session{
+		Session: vs,
+		laddr:   c.LocalAddr(),
+		raddr:   c.RemoteAddr(),
+	}
+	for _, st := range s.Streams() {
+		s.conns = append(s.conns, newMuxConn(st, s.laddr, s.raddr))
+	}
+	return s
 }
 
-func (*muxConn) SetWriteDeadline(time.Time) error {
-	return errors.New("muxConn does not implement deadlines")
+// Dial opens a new stream to the peer, which receives it from the Accept
+// method of its Listener.
+func (s *Session) Dial() (net.Conn, error) {
+	st, err := s.Open()
+	if err != nil {
+		return nil, err
+	}
+	return newMuxConn(st, s.laddr, s.raddr), nil
 }
 
-func Split(c net.Conn, n uint) []net.Conn {
-	rwcs := viomux.SplitReadWriteCloser(c, n)
-	var r []net.Conn
-	laddr := c.LocalAddr()
-	raddr := c.RemoteAddr()
-	for _, rwc := range rwcs {
-		r = append(r, &muxConn{rwc, laddr, raddr})
+// Listener returns a net.Listener whose Accept returns the streams opened by
+// the peer with Dial. Closing the listener stops accepting new streams but
+// leaves the session and its existing streams open.
+//
+// The listener can be passed to http.Serve or used with rpc.Server.Accept to
+// serve a protocol over a single multiplexed connection.
+func (s *Session) Listener() net.Listener {
+	return (*listener)(s)
+}
+
+type listener Session
+
+func (l *listener) Accept() (net.Conn, error) {
+	st, err := l.Session.Accept()
+	if err != nil {
+		return nil, err
 	}
-	return r
+	return newMuxConn(st, l.laddr, l.raddr), nil
+}
+
+func (l *listener) Close() error {
+	return l.Session.CloseAccept()
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.laddr
+}
+
+// Conns returns the net.Conn's of the session, in order.
+func (s *Session) Conns() []net.Conn {
+	return append([]net.Conn(nil), s.conns...)
+}
+
+// Split a net.Conn into 'n' net.Conn's using a session with default options,
+// which send keepalive pings. When all returned net.Conn's have been
+// Close()'d, c is also closed.
+//
+// Split speaks the Session wire format, not the legacy format of
+// io/multiplex.SplitReadWriteCloser, and fails with
+// io/multiplex.ErrWireFormat if the peer speaks the legacy format; see the
+// package documentation.
+func Split(c net.Conn, n uint) []net.Conn {
+	return NewSession(c, n, nil).Conns()
 }
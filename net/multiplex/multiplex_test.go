@@ -1,8 +1,16 @@
 package multiplex
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/vsekhar/govtil/io/multiplex"
 	vtesting "github.com/vsekhar/govtil/testing"
@@ -23,3 +31,174 @@ func TestSplitConn(t *testing.T) {
 
 	multiplex.DoTestBiDirectional(t, rwcs1, rwcs2)
 }
+
+func TestDeadlines(t *testing.T) {
+	c1, c2 := vtesting.SelfConnection()
+	c1s := Split(c1, 2)
+	c2s := Split(c2, 2)
+
+	// read deadline
+	c1s[0].SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := c1s[0].Read(make([]byte, 10))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+
+	// other streams and the expired stream itself keep working
+	c1s[0].SetReadDeadline(time.Time{})
+	rwcs1 := []io.ReadWriteCloser{c1s[0], c1s[1]}
+	rwcs2 := []io.ReadWriteCloser{c2s[0], c2s[1]}
+	multiplex.DoTestBiDirectional(t, rwcs1, rwcs2)
+
+	// write deadline: nobody reads c2s[1], so its window fills up
+	c1s[1].SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	big := make([]byte, 1<<20)
+	n, err := c1s[1].Write(big)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if n == 0 || n >= len(big) {
+		t.Errorf("expected partial write, wrote %d of %d", n, len(big))
+	}
+}
+
+var msg = []byte("hello")
+
+func TestListenerAndDial(t *testing.T) {
+	c1, c2 := vtesting.SelfConnection()
+	s1 := NewSession(c1, 0, nil)
+	s2 := NewSession(c2, 0, nil)
+	defer s1.Close()
+	defer s2.Close()
+
+	l := s1.Listener()
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	}))
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(string, string) (net.Conn, error) {
+			return s2.Dial()
+		},
+	}}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("http://mux/")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		if !strings.HasPrefix(string(body), c1.RemoteAddr().String()+"/") {
+			t.Errorf("bad remote address '%s'", body)
+		}
+	}
+
+	// both ends can dial
+	go func() {
+		c, err := s1.Dial()
+		if err == nil {
+			c.Write(msg)
+			c.Close()
+		}
+	}()
+	c, err := s2.Listener().Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	d, err := ioutil.ReadAll(c)
+	if err != nil || !bytes.Equal(d, msg) {
+		t.Errorf("expected '%s', got '%s' (%v)", msg, d, err)
+	}
+}
+
+func TestMessageConn(t *testing.T) {
+	c1, c2 := vtesting.SelfConnection()
+	c1s := Split(c1, 1)
+	c2s := Split(c2, 1)
+	mc1, ok := c1s[0].(MessageConn)
+	if !ok {
+		t.Fatalf("%T is not a MessageConn", c1s[0])
+	}
+	mc2 := c2s[0].(MessageConn)
+	go mc1.SendMsg(msg)
+	m, err := mc2.RecvMsg()
+	if err != nil || !bytes.Equal(m, msg) {
+		t.Errorf("expected '%s', got '%s' (%v)", msg, m, err)
+	}
+}
+
+func TestResumeListenerTimeouts(t *testing.T) {
+	rl := NewResumeListener(nil, 1, nil)
+	defer rl.Close()
+	if d := rl.opts.ResumeTimeout; d != DefaultResumeTimeout {
+		t.Errorf("ResumeTimeout %v, want %v", d, DefaultResumeTimeout)
+	}
+
+	// a connection that never sends its hello is dropped
+	defer func(d time.Duration) { HelloTimeout = d }(HelloTimeout)
+	HelloTimeout = 20 * time.Millisecond
+	c0, c1 := net.Pipe()
+	defer c1.Close()
+	done := make(chan error, 1)
+	go func() { done <- rl.ServeConn(c0) }()
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("expected a timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn waited for a hello indefinitely")
+	}
+}
+
+func TestResumable(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	rl := NewResumeListener(l, 1, nil)
+	defer rl.Close()
+
+	var mu sync.Mutex
+	var last net.Conn
+	dial := func() (net.Conn, error) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		mu.Lock()
+		last = c
+		mu.Unlock()
+		return c, err
+	}
+	cs, err := DialResumable(dial, 1, nil)
+	if err != nil {
+		t.Fatalf("DialResumable: %v", err)
+	}
+	defer cs.Close()
+	ss, err := rl.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer ss.Close()
+
+	c, s := cs.Conns()[0], ss.Conns()[0]
+	for i := 0; i < 3; i++ {
+		if _, err := c.Write(msg); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		r := make([]byte, len(msg))
+		if _, err := io.ReadFull(s, r); err != nil {
+			t.Fatalf("ReadFull: %v", err)
+		}
+		if !bytes.Equal(r, msg) {
+			t.Fatalf("expected '%s', got '%s'", msg, r)
+		}
+
+		// network blip
+		mu.Lock()
+		last.Close()
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,262 @@
+package multiplex
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	viomux "github.com/vsekhar/govtil/io/multiplex"
+	"github.com/vsekhar/govtil/log"
+)
+
+// Delays between attempts to re-establish the connection of a session
+// created with DialResumable.
+var (
+	MinRedialDelay = 100 * time.Millisecond
+	MaxRedialDelay = 10 * time.Second
+)
+
+// DefaultResumeTimeout is how long a ResumeListener keeps a disconnected
+// session waiting to be resumed, if its options do not set ResumeTimeout.
+// Until then the session holds its goroutines and unacknowledged frames.
+var DefaultResumeTimeout = 2 * time.Minute
+
+// HelloTimeout limits the time ServeConn waits for a connection's hello.
+var HelloTimeout = 10 * time.Second
+
+// ErrListenerClosed is returned by ResumeListener.Accept once the listener
+// has been closed.
+var ErrListenerClosed = errors.New("govtil/net/multiplex: listener closed")
+
+// resumable returns a copy of opts with Resumable set.
+func resumable(opts *viomux.Options) *viomux.Options {
+	if opts == nil {
+		opts = &viomux.DefaultOptions
+	}
+	o := *opts
+	o.Resumable = true
+	return &o
+}
+
+// DialResumable starts a resumable session over a connection returned by
+// dial, e.g. a TCP or websocket connection to a ResumeListener. If the
+// connection is lost, dial is called again with exponential backoff and the
+// session resumed, until the session is closed or opts.ResumeTimeout passes.
+//
+// Resumable is set on a copy of opts, so nil may be passed for default
+// options. LocalAddr and RemoteAddr of the session's net.Conn's refer to the
+// first connection.
+func DialResumable(dial func() (net.Conn, error), n uint, opts *viomux.Options) (*Session, error) {
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	s := NewSession(c, n, resumable(opts))
+	go s.redial(dial)
+	return s, nil
+}
+
+func (s *Session) redial(dial func() (net.Conn, error)) {
+	s.Token() // wait for the initial handshake
+	for {
+		select {
+		case <-s.Disconnected():
+		case <-s.Done():
+			return
+		}
+
+		delay := MinRedialDelay
+		for s.Err() == nil {
+			c, err := dial()
+			if err == nil {
+				if err = s.Resume(c, nil); err == nil {
+					log.Printf("govtil/net/multiplex: resumed session %v", s.Token())
+					break
+				}
+			}
+			log.Printf("govtil/net/multiplex: failed to resume session %v: %v", s.Token(), err)
+			select {
+			case <-time.After(delay):
+			case <-s.Done():
+				return
+			}
+			if delay *= 2; delay > MaxRedialDelay {
+				delay = MaxRedialDelay
+			}
+		}
+	}
+}
+
+// ResumeListener accepts resumable sessions. Connections that start a new
+// session are returned from Accept, connections that resume a known session
+// are handed to it.
+//
+// A connection resumes a session by presenting its token, which is sent in
+// the clear in the hellos of the session's connections, and then replaces
+// the session's connection. Anyone who can read or guess the token can take
+// over the session, so ResumeListeners must only serve connections secured
+// with TLS, or connections whose peer has otherwise been authenticated.
+type ResumeListener struct {
+	n    uint
+	opts *viomux.Options
+	l    net.Listener
+
+	mu       sync.Mutex
+	sessions map[viomux.Token]*Session
+	accepts  chan *Session
+	die      chan struct{}
+	closed   bool
+}
+
+// NewResumeListener returns a ResumeListener for sessions with n streams
+// over the connections accepted by l. Resumable is set on a copy of opts, so
+// nil may be passed for default options. If opts has no ResumeTimeout,
+// DefaultResumeTimeout is used; a negative ResumeTimeout keeps disconnected
+// sessions until they are closed.
+//
+// If l is nil, connections must be passed to ServeConn instead (e.g. from a
+// websocket.Handler).
+func NewResumeListener(l net.Listener, n uint, opts *viomux.Options) *ResumeListener {
+	rl := &ResumeListener{
+		n:        n,
+		opts:     resumable(opts),
+		l:        l,
+		sessions: make(map[viomux.Token]*Session),
+		accepts:  make(chan *Session),
+		die:      make(chan struct{}),
+	}
+	if rl.opts.ResumeTimeout == 0 {
+		rl.opts.ResumeTimeout = DefaultResumeTimeout
+	}
+	if l != nil {
+		go rl.serve()
+	}
+	return rl
+}
+
+func (rl *ResumeListener) serve() {
+	for {
+		c, err := rl.l.Accept()
+		if err != nil {
+			if !rl.isClosed() {
+				log.Errorf("govtil/net/multiplex: accept failed: %v", err)
+				rl.Close()
+			}
+			return
+		}
+		go rl.ServeConn(c)
+	}
+}
+
+// notifyConn reports when it is closed, i.e. when a session has stopped
+// using it.
+type notifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (nc *notifyConn) Close() error {
+	nc.once.Do(func() { close(nc.closed) })
+	return nc.Conn.Close()
+}
+
+// ServeConn starts or resumes a session over c. It returns once the session
+// no longer uses c, so that it can be called from handlers that close their
+// connection on return. c must be secured; see ResumeListener.
+func (rl *ResumeListener) ServeConn(c net.Conn) error {
+	nc := &notifyConn{Conn: c, closed: make(chan struct{})}
+	nc.SetReadDeadline(time.Now().Add(HelloTimeout))
+	h, err := viomux.ReadHello(nc)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	nc.SetReadDeadline(time.Time{})
+
+	if h.Resume {
+		rl.mu.Lock()
+		s := rl.sessions[h.Token]
+		rl.mu.Unlock()
+		if s == nil {
+			log.Printf("govtil/net/multiplex: rejecting unknown session %v from %v", h.Token, c.RemoteAddr())
+			viomux.Reject(nc)
+			nc.Close()
+			return viomux.ErrResumeRejected
+		}
+		if err := s.Resume(nc, h); err != nil {
+			return err
+		}
+	} else {
+		vs, err := viomux.AcceptSession(nc, h, rl.n, rl.opts)
+		if err != nil {
+			nc.Close()
+			return err
+		}
+		s := wrap(vs, c)
+		if !rl.add(s) {
+			s.Close()
+			return ErrListenerClosed
+		}
+		select {
+		case rl.accepts <- s:
+		case <-rl.die:
+			s.Close()
+			return ErrListenerClosed
+		}
+	}
+	<-nc.closed
+	return nil
+}
+
+// add tracks s until it is done, returning false if the listener is closed.
+func (rl *ResumeListener) add(s *Session) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.closed {
+		return false
+	}
+	token := s.Token()
+	rl.sessions[token] = s
+	go func() {
+		<-s.Done()
+		rl.mu.Lock()
+		delete(rl.sessions, token)
+		rl.mu.Unlock()
+	}()
+	return true
+}
+
+// Accept waits for and returns the next new session.
+func (rl *ResumeListener) Accept() (*Session, error) {
+	select {
+	case s := <-rl.accepts:
+		return s, nil
+	case <-rl.die:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stops accepting new sessions and closes the underlying listener, if
+// any. Sessions already accepted can still be resumed.
+func (rl *ResumeListener) Close() error {
+	rl.mu.Lock()
+	if rl.closed {
+		rl.mu.Unlock()
+		return nil
+	}
+	rl.closed = true
+	close(rl.die)
+	rl.mu.Unlock()
+	if rl.l != nil {
+		return rl.l.Close()
+	}
+	return nil
+}
+
+func (rl *ResumeListener) isClosed() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.closed
+}
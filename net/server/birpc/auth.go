@@ -0,0 +1,172 @@
+package birpc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/gob"
+	"errors"
+)
+
+// An Authenticator runs on both ends of a new connection after hellos are
+// exchanged and before any RPCs are made. It exchanges messages with the
+// peer's Authenticator through h and returns an error to reject the peer.
+//
+// Both ends of a connection must use compatible Authenticators, such as
+// SharedSecret with the same secret.
+type Authenticator func(h *Handshake) error
+
+// Handshake is the control stream of a connection being authenticated.
+type Handshake struct {
+	Peer   *Hello // hello received from the peer
+	Dialer bool   // true on the dialing end of the connection
+
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+// handshakeMsg carries Authenticator messages and, once an end has finished
+// authenticating its peer, its verdict.
+type handshakeMsg struct {
+	Data   []byte
+	Done   bool
+	Reject string
+}
+
+// RejectedError is returned when the peer refuses a connection.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "govtil/net/server/birpc: rejected by peer: " + e.Reason
+}
+
+// Send sends b to the peer's Authenticator.
+func (h *Handshake) Send(b []byte) error {
+	return h.enc.Encode(&handshakeMsg{Data: b})
+}
+
+// Recv receives a message sent by the peer's Authenticator. If the peer has
+// rejected the connection, the error is a *RejectedError.
+func (h *Handshake) Recv() ([]byte, error) {
+	var m handshakeMsg
+	if err := h.dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	if m.Reject != "" {
+		return nil, &RejectedError{m.Reject}
+	}
+	if m.Done {
+		return nil, errors.New("govtil/net/server/birpc: peer did not authenticate")
+	}
+	return m.Data, nil
+}
+
+// authenticate runs auth, if any, and exchanges verdicts with the peer.
+func (h *Handshake) authenticate(auth Authenticator) error {
+	var err error
+	if auth != nil {
+		err = auth(h)
+	}
+	if _, ok := err.(*RejectedError); ok {
+		return err
+	}
+	verdict := &handshakeMsg{Done: true}
+	if err != nil {
+		verdict.Reject = err.Error()
+	}
+	if werr := h.enc.Encode(verdict); werr != nil && err == nil {
+		return werr
+	}
+
+	// Wait for the peer's verdict, skipping anything it sent that auth did
+	// not expect. An end that rejects its peer waits too, so that it does
+	// not close the connection before the peer has read the rejection.
+	for {
+		var m handshakeMsg
+		if derr := h.dec.Decode(&m); derr != nil {
+			if err == nil {
+				err = derr
+			}
+			return err
+		}
+		if err != nil && m.Done {
+			return err
+		}
+		if m.Reject != "" {
+			return &RejectedError{m.Reject}
+		}
+		if m.Done {
+			return nil
+		}
+	}
+}
+
+// ErrBadCredentials is returned by the Authenticators in this package when
+// the peer's credentials do not match.
+var ErrBadCredentials = errors.New("govtil/net/server/birpc: bad credentials")
+
+// SharedSecret returns an Authenticator with which both ends prove they know
+// secret, without sending it. Each end sends a random challenge and checks
+// that the peer's response is an HMAC-SHA256 of it keyed with secret.
+func SharedSecret(secret []byte) Authenticator {
+	return func(h *Handshake) error {
+		challenge := make([]byte, 32)
+		if _, err := rand.Read(challenge); err != nil {
+			return err
+		}
+		if err := h.Send(challenge); err != nil {
+			return err
+		}
+		peerChallenge, err := h.Recv()
+		if err != nil {
+			return err
+		}
+		if err := h.Send(respond(secret, peerChallenge, h.Dialer)); err != nil {
+			return err
+		}
+		response, err := h.Recv()
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal(response, respond(secret, challenge, !h.Dialer)) {
+			return ErrBadCredentials
+		}
+		return nil
+	}
+}
+
+// respond computes the response to a challenge. The role of the responding
+// end is included so that a challenge cannot be reflected back to its sender.
+func respond(secret, challenge []byte, dialer bool) []byte {
+	m := hmac.New(sha256.New, secret)
+	if dialer {
+		m.Write([]byte("dialer"))
+	} else {
+		m.Write([]byte("acceptor"))
+	}
+	m.Write(challenge)
+	return m.Sum(nil)
+}
+
+// BearerToken returns an Authenticator with which the dialing end presents
+// token and the accepting end checks that it matches. The dialing end does
+// not authenticate the accepting end, so the token should only be sent over
+// a connection that is otherwise secured.
+func BearerToken(token string) Authenticator {
+	return func(h *Handshake) error {
+		if h.Dialer {
+			return h.Send([]byte(token))
+		}
+		b, err := h.Recv()
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(b, []byte(token)) != 1 {
+			return ErrBadCredentials
+		}
+		return nil
+	}
+}
@@ -1,37 +1,375 @@
 // Package birpc provides a bi-directional RPC handler. Incoming connections
 // are muxed, with one connection going to the RPC server and another client
 // connection being provided to the application.
+//
+// Connections can be carried over websockets (Handler and Dial) or over any
+// net.Listener and net.Conn, such as TCP or Unix domain sockets (Serve and
+// DialNet).
+//
+// Each connection also carries a control stream on which the two ends
+// exchange a Hello when they connect, and on which an Authenticator can
+// check the peer's credentials before any RPCs are made. An Endpoint
+// configures the name and metadata it announces and how it authenticates
+// peers, and can record connected peers in a Registry.
+//
+// Calls made with CallContext carry their deadline to the peer and are
+// cancelled on the peer when their context is done. Methods find the context
+// of the call they are serving with Context.
+//
+// Besides the unary methods of net/rpc, peers can serve streaming methods
+// that send and receive any number of values (see StreamServer and
+// Peer.OpenStream). Each streaming call has its own multiplexed stream.
+//
+// Unary calls are gob-encoded by default. The dialing end of a connection
+// can instead request JSON-RPC (see Endpoint.Codec). Only the bodies of
+// unary calls are then JSON; the connection itself is still birpc's. Peers
+// that do not use birpc can make plain JSON-RPC calls over a websocket (see
+// Endpoint.Handler).
 package birpc
 
 import (
+	"crypto/tls"
+	"encoding/gob"
+	"net"
 	"net/rpc"
+	"sync"
+	"time"
 
 	"golang.org/x/net/websocket"
 
+	"github.com/vsekhar/govtil/log"
 	"github.com/vsekhar/govtil/net/multiplex"
 )
 
+// Streams of a birpc connection
+const (
+	acceptorServer = iota // RPC server of the accepting end
+	dialerServer          // RPC server of the dialing end
+	control               // hello and other control messages
+	numStreams
+)
+
+// Hello is exchanged by both ends when a connection is established.
+type Hello struct {
+	Name     string
+	Metadata map[string]string
+	Codec    string // requested by the dialing end, chosen by the accepting end
+
+	// Set by the accepting end if it does not support the requested Codec,
+	// in which case the connection is closed.
+	UnsupportedCodec bool
+}
+
+// Peer is the remote end of a birpc connection.
+type Peer struct {
+	ID         uint64 // assigned by the Registry, zero if there is none
+	Name       string
+	Metadata   map[string]string
+	RemoteAddr net.Addr
+	Connected  time.Time
+	Codec      string // of the RPC streams, Gob or JSONRPC
+
+	// Client calls methods on the peer's rpc.Server
+	Client *rpc.Client
+
+	session      *multiplex.Session
+	client       *clientCodec
+	server       *serverCodec
+	interceptors []Interceptor // for calls to the peer
+	ctlMu        sync.Mutex
+	ctl          *gob.Encoder
+}
+
+// Done returns a channel that is closed when the connection to the peer is
+// lost or closed.
+func (p *Peer) Done() <-chan struct{} {
+	return p.session.Done()
+}
+
+// Err returns the reason the connection to the peer was lost or closed, or
+// nil if it is still open.
+func (p *Peer) Err() error {
+	return p.session.Err()
+}
+
+// Close closes the connection to the peer.
+func (p *Peer) Close() error {
+	return p.session.Close()
+}
+
+// Endpoint configures one end of birpc connections. The zero value serves no
+// methods and announces no name.
+type Endpoint struct {
+	// Server serves calls from peers. If nil, peers can call no methods.
+	Server *rpc.Server
+
+	// Streams serves streaming calls from peers. If nil, peers can call no
+	// streaming methods.
+	Streams *StreamServer
+
+	// If not nil, Clients receives a client for each accepted connection.
+	Clients chan<- *rpc.Client
+
+	// Name and Metadata are sent to peers in the Hello
+	Name     string
+	Metadata map[string]string
+
+	// If not nil, connected peers are recorded in Registry until they
+	// disconnect.
+	Registry *Registry
+
+	// Interceptors run around calls served to peers and calls made on
+	// peers with Peer.Call and Peer.CallContext, in order.
+	ServerInterceptors []Interceptor
+	ClientInterceptors []Interceptor
+
+	// Codec is requested for the RPC streams of connections dialed by the
+	// Endpoint: Gob (the default) or JSONRPC. The accepting end of a
+	// connection uses the codec requested by the dialing end.
+	Codec string
+
+	// If not nil, Auth authenticates peers before any RPCs are made. Peers
+	// it rejects are disconnected.
+	Auth Authenticator
+
+	// HandshakeTimeout limits the time taken to exchange hellos and
+	// authenticate. If zero, DefaultHandshakeTimeout is used.
+	HandshakeTimeout time.Duration
+
+	// If not nil, TLSConfig is used by Dial for wss:// URLs and by DialNet,
+	// which then connects over TLS.
+	TLSConfig *tls.Config
+}
+
+// DefaultHandshakeTimeout is used by Endpoints that do not set
+// HandshakeTimeout.
+const DefaultHandshakeTimeout = 30 * time.Second
+
+var emptyServer = rpc.NewServer()
+
+func (e *Endpoint) server() *rpc.Server {
+	if e.Server == nil {
+		return emptyServer
+	}
+	return e.Server
+}
+
 func Handler(srv *rpc.Server, cch chan<- *rpc.Client) websocket.Handler {
+	return (&Endpoint{Server: srv, Clients: cch}).Handler()
+}
+
+// Handler returns a websocket.Handler that serves each connection until it is
+// closed.
+//
+// Peers that do not use birpc, such as browsers, can connect with the query
+// "?codec=jsonrpc" to have e.Server served as plain JSON-RPC over the
+// websocket, one message per frame, without multiplexing or a Hello. Such
+// peers can make unary calls only: they cannot be called back, serve or call
+// streaming methods, or carry deadlines, and Interceptors see them with a
+// nil Peer. They cannot be authenticated either, so if e.Auth is set they
+// are disconnected.
+func (e *Endpoint) Handler() websocket.Handler {
 	return websocket.Handler(func(c *websocket.Conn) {
-		muxed := multiplex.Split(c, 2)
+		if c.Request().URL.Query().Get("codec") == JSONRPC {
+			e.serveJSON(c)
+			return
+		}
+		e.serveConn(c)
+	})
+}
+
+// serveJSON serves e.Server as plain JSON-RPC on c until it is closed.
+func (e *Endpoint) serveJSON(c *websocket.Conn) {
+	if e.Auth != nil {
+		log.Errorf("govtil/net/server/birpc: plain JSON-RPC connection from %v refused: peers must authenticate", c.Request().RemoteAddr)
+		c.Close()
+		return
+	}
+	c.PayloadType = websocket.TextFrame
+	e.server().ServeCodec(newServerCodec(JSONRPC, c, e.server(), e.ServerInterceptors))
+	log.Debugf("govtil/net/server/birpc: plain JSON-RPC connection from %v closed", c.Request().RemoteAddr)
+}
+
+// Serve accepts connections on l and serves each one as Handler does. It
+// returns when l.Accept fails, e.g. because l has been closed.
+func Serve(l net.Listener, srv *rpc.Server, cch chan<- *rpc.Client) error {
+	return (&Endpoint{Server: srv, Clients: cch}).Serve(l)
+}
+
+// Serve accepts connections on l and serves each one as Handler does.
+func (e *Endpoint) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go e.serveConn(c)
+	}
+}
+
+// serveConn serves the accepting end of a connection until it is closed.
+func (e *Endpoint) serveConn(c net.Conn) {
+	p, err := e.connect(c, acceptorServer, dialerServer)
+	if err != nil {
+		log.Errorf("govtil/net/server/birpc: connection from %v failed: %v", c.RemoteAddr(), err)
+		return
+	}
+	if e.Clients != nil {
 		go func() {
-			cch <- rpc.NewClient(muxed[1])
+			e.Clients <- p.Client
 		}()
-		srv.ServeConn(muxed[0])
-	})
+	}
+	<-p.Done()
+	log.Debugf("govtil/net/server/birpc: connection from %v closed", c.RemoteAddr())
 }
 
 // On the dialing side, Dial opens a socket to a listener, serves one end itself
 // and returns the other end as an rpc.Client.
 func Dial(url string, srv *rpc.Server) (client *rpc.Client, err error) {
-	conn, err := websocket.Dial(url, "", "http://localhost")
+	p, err := (&Endpoint{Server: srv}).Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return p.Client, nil
+}
+
+// DialTLS is the same as Dial except it uses config for wss:// URLs.
+func DialTLS(url string, config *tls.Config, srv *rpc.Server) (*rpc.Client, error) {
+	p, err := (&Endpoint{Server: srv, TLSConfig: config}).Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return p.Client, nil
+}
+
+// Dial connects to a websocket Handler at url.
+func (e *Endpoint) Dial(url string) (*Peer, error) {
+	conn, err := dialWebsocket(url, e.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	return e.connect(conn, dialerServer, acceptorServer)
+}
+
+// DialNet is the same as Dial except it connects to a listener passed to Serve,
+// using a network and address as accepted by net.Dial, e.g. "tcp" and
+// "localhost:1234", or "unix" and "/path/to/socket".
+func DialNet(network, addr string, srv *rpc.Server) (*rpc.Client, error) {
+	p, err := (&Endpoint{Server: srv}).DialNet(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return p.Client, nil
+}
+
+// DialNet connects to a listener passed to Serve.
+func (e *Endpoint) DialNet(network, addr string) (*Peer, error) {
+	conn, err := dialNet(network, addr, e.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	return e.connect(conn, dialerServer, acceptorServer)
+}
+
+func dialWebsocket(url string, config *tls.Config) (net.Conn, error) {
+	wsc, err := websocket.NewConfig(url, "http://localhost")
+	if err != nil {
+		return nil, err
+	}
+	wsc.TlsConfig = config
+	return websocket.DialConfig(wsc)
+}
+
+func dialNet(network, addr string, config *tls.Config) (net.Conn, error) {
+	if config != nil {
+		return tls.Dial(network, addr, config)
+	}
+	return net.Dial(network, addr)
+}
+
+// connect sets up either end of a connection: it exchanges hellos,
+// negotiating the codec, and authenticates the peer. It then serves the
+// local RPC server on stream srvID and calls the peer on stream cliID.
+func (e *Endpoint) connect(c net.Conn, srvID, cliID int) (*Peer, error) {
+	s := multiplex.NewSession(c, numStreams, nil)
+	conns := s.Conns()
+
+	ctl := conns[control]
+	timeout := e.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	ctl.SetDeadline(time.Now().Add(timeout))
+	h := &Handshake{
+		Peer:   new(Hello),
+		Dialer: srvID == dialerServer,
+		enc:    gob.NewEncoder(ctl),
+		dec:    gob.NewDecoder(ctl),
+	}
+	// the dialing end requests a codec, to which the accepting end replies
+	mine := &Hello{Name: e.Name, Metadata: e.Metadata}
+	var err error
+	if h.Dialer {
+		mine.Codec = e.Codec
+		if err = h.enc.Encode(mine); err == nil {
+			err = h.dec.Decode(h.Peer)
+		}
+		if err == nil && h.Peer.UnsupportedCodec {
+			err = &UnsupportedCodecError{e.Codec}
+		} else if err == nil {
+			mine.Codec, err = negotiate(h.Peer.Codec)
+		}
+	} else if err = h.dec.Decode(h.Peer); err == nil {
+		var codecErr error
+		if mine.Codec, codecErr = negotiate(h.Peer.Codec); codecErr != nil {
+			mine.Codec, mine.UnsupportedCodec = h.Peer.Codec, true
+		}
+		if err = h.enc.Encode(mine); err == nil && codecErr != nil {
+			// wait for the dialing end to read the hello and hang up
+			h.dec.Decode(new(handshakeMsg))
+			err = codecErr
+		}
+	}
+	if err == nil {
+		err = h.authenticate(e.Auth)
+	}
 	if err != nil {
+		s.Close()
 		return nil, err
 	}
-	muxed := multiplex.Split(conn, 2)
+	ctl.SetDeadline(time.Time{})
+
+	p := &Peer{
+		Name:       h.Peer.Name,
+		Metadata:   h.Peer.Metadata,
+		RemoteAddr: c.RemoteAddr(),
+		Connected:  time.Now(),
+		Codec:      mine.Codec,
+		client:     newClientCodec(mine.Codec, conns[cliID]),
+		session:    s,
+		server:     newServerCodec(mine.Codec, conns[srvID], e.server(), e.ServerInterceptors),
+		ctl:        h.enc,
 
-	// Server on second, client on first (reverse of above)
-	client = rpc.NewClient(muxed[0])
-	go srv.ServeConn(muxed[1])
-	return
+		interceptors: e.ClientInterceptors,
+	}
+	p.Client = rpc.NewClientWithCodec(p.client)
+	p.server.peer = p
+	if e.Registry != nil {
+		e.Registry.add(p)
+	}
+	go func() {
+		// the connection ends when either end stops serving
+		e.server().ServeCodec(p.server)
+		s.Close()
+	}()
+	go p.control(h.dec)
+	go p.acceptStreams(e.Streams)
+	go func() {
+		<-s.Done()
+		p.Client.Close()
+		if e.Registry != nil {
+			e.Registry.remove(p)
+		}
+	}()
+	return p, nil
 }
@@ -1,13 +1,26 @@
 package birpc
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
-//	"golang.org/x/net/websocket"
+	"golang.org/x/net/websocket"
 
 	"github.com/vsekhar/govtil/log"
 	vnet "github.com/vsekhar/govtil/net"
@@ -90,4 +103,748 @@ func TestBiRPC(t *testing.T) {
 	if quot.Quo != 8 || quot.Rem != 0 {
 		t.Errorf("bad quot %v", quot)
 	}
-}
\ No newline at end of file
+}
+// Make calls in both directions over a birpc connection
+func doTestCalls(t *testing.T, dialClient, serverClient *rpc.Client) {
+	prod := Product{}
+	if err := dialClient.Call("Arith.Multiply", &Args{3, 5}, &prod); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if prod.R != 15 {
+		t.Errorf("bad prod '%d', expected %d", prod.R, 15)
+	}
+	quot := Quotient{}
+	if err := serverClient.Call("Arith.Divide", &Args{17, 5}, &quot); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if quot.Quo != 3 || quot.Rem != 2 {
+		t.Errorf("bad quot %v", quot)
+	}
+}
+
+func TestServeAndDialNet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "birpc")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, network := range []string{"tcp", "unix"} {
+		addr := "localhost:0"
+		if network == "unix" {
+			addr = filepath.Join(dir, "birpc.sock")
+		}
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		srv := rpc.NewServer()
+		srv.Register(new(Arith))
+		clientch := make(chan *rpc.Client)
+		go Serve(l, srv, clientch)
+
+		dialClient, err := DialNet(network, l.Addr().String(), srv)
+		if err != nil {
+			t.Fatalf("DialNet(%s): %v", network, err)
+		}
+		doTestCalls(t, dialClient, <-clientch)
+		dialClient.Close()
+		l.Close()
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	reg := new(Registry)
+	var intercepted int32
+	hub := &Endpoint{Name: "hub", Registry: reg, ClientInterceptors: []Interceptor{
+		func(c *Call, next func() error) error {
+			atomic.AddInt32(&intercepted, 1)
+			return next()
+		},
+	}}
+	go hub.Serve(l)
+
+	var peers []*Peer
+	for i, name := range []string{"a", "b", "a"} {
+		srv := rpc.NewServer()
+		srv.Register(new(Arith))
+		if i == 0 {
+			srv.Register(&Waiter{make(chan bool, 1), make(chan error, 1)})
+		}
+		e := &Endpoint{
+			Server:   srv,
+			Name:     name,
+			Metadata: map[string]string{"i": fmt.Sprint(i)},
+		}
+		p, err := e.DialNet("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("DialNet: %v", err)
+		}
+		if p.Name != "hub" {
+			t.Errorf("expected hello from 'hub', got '%s'", p.Name)
+		}
+		peers = append(peers, p)
+	}
+	for i := 0; i < 100 && reg.Len() < len(peers); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if reg.Len() != len(peers) {
+		t.Fatalf("expected %d peers, got %d", len(peers), reg.Len())
+	}
+	if p := reg.Lookup("a"); p == nil || p.Metadata["i"] != "2" {
+		t.Errorf("Lookup returned %+v, expected most recent peer 'a'", p)
+	}
+	if p := reg.Lookup("c"); p != nil {
+		t.Errorf("Lookup of unknown name returned %+v", p)
+	}
+
+	ctx := context.Background()
+	if _, err := reg.Broadcast(ctx, "Arith.Multiply", &Args{2, 3}, nil); err == nil {
+		t.Errorf("Broadcast accepted a nil reply")
+	}
+	if _, err := reg.Broadcast(ctx, "Arith.Multiply", &Args{2, 3}, Product{}); err == nil {
+		t.Errorf("Broadcast accepted a non-pointer reply")
+	}
+	results, err := reg.Broadcast(ctx, "Arith.Multiply", &Args{2, 3}, new(Product))
+	if err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	if n := atomic.LoadInt32(&intercepted); n != int32(len(peers)) {
+		t.Errorf("interceptor ran %d times, expected %d", n, len(peers))
+	}
+	if len(results) != len(peers) {
+		t.Fatalf("expected %d results, got %d", len(peers), len(results))
+	}
+	for i, r := range results {
+		if r.Error != nil {
+			t.Errorf("peer %d: %v", r.Peer.ID, r.Error)
+		} else if r.Reply.(*Product).R != 6 {
+			t.Errorf("peer %d: bad prod %v", r.Peer.ID, r.Reply)
+		}
+		if i > 0 && r.Peer.ID <= results[i-1].Peer.ID {
+			t.Errorf("results out of order")
+		}
+	}
+
+	// a hung peer does not hold up Broadcast past its context
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	results, err = reg.Broadcast(ctx, "Waiter.Wait", &Args{}, new(Product))
+	if err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	if err := results[0].Error; err != context.DeadlineExceeded {
+		t.Errorf("hung peer: expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if results[1].Error == nil {
+		t.Errorf("peer without Waiter: expected an error")
+	}
+
+	// peers are removed when they disconnect
+	peers[1].Close()
+	for i := 0; i < 100 && reg.Len() == len(peers); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if reg.Lookup("b") != nil || reg.Len() != len(peers)-1 {
+		t.Errorf("peer 'b' not removed")
+	}
+	var names []string
+	reg.Each(func(p *Peer) {
+		names = append(names, p.Name)
+	})
+	if fmt.Sprint(names) != "[a a]" {
+		t.Errorf("Each visited %v", names)
+	}
+
+	// Empty is closed once the last peer disconnects
+	empty := reg.Empty()
+	select {
+	case <-empty:
+		t.Errorf("Empty closed with %d peers", reg.Len())
+	default:
+	}
+	peers[0].Close()
+	peers[2].Close()
+	select {
+	case <-empty:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Empty not closed, %d peers left", reg.Len())
+	}
+	if reg.Len() != 0 {
+		t.Errorf("Empty closed with %d peers", reg.Len())
+	}
+}
+
+func TestAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	srv := rpc.NewServer()
+	srv.Register(new(Arith))
+	accepted := make(chan *rpc.Client, 1)
+	var accepting Authenticator
+	acceptor := &Endpoint{
+		Server:  srv,
+		Clients: accepted,
+		Auth: func(h *Handshake) error {
+			return accepting(h)
+		},
+	}
+	go acceptor.Serve(l)
+
+	cases := []struct {
+		name       string
+		acceptAuth Authenticator
+		dialAuth   Authenticator
+		ok         bool
+	}{
+		{"secret", SharedSecret([]byte("s3cret")), SharedSecret([]byte("s3cret")), true},
+		{"bad secret", SharedSecret([]byte("s3cret")), SharedSecret([]byte("guess")), false},
+		{"token", BearerToken("t0ken"), BearerToken("t0ken"), true},
+		{"bad token", BearerToken("t0ken"), BearerToken("guess"), false},
+		{"no credentials", BearerToken("t0ken"), nil, false},
+		{"custom", func(h *Handshake) error {
+			if h.Peer.Name != "friend" {
+				return errors.New("go away")
+			}
+			return nil
+		}, nil, false},
+	}
+	var last error
+	for _, c := range cases {
+		accepting = c.acceptAuth
+		dialer := &Endpoint{Server: srv, Auth: c.dialAuth, Name: "stranger"}
+		p, err := dialer.DialNet("tcp", l.Addr().String())
+		last = err
+		if !c.ok {
+			// with a shared secret, both ends reject each other
+			if _, ok := err.(*RejectedError); !ok && err != ErrBadCredentials {
+				t.Errorf("%s: expected rejection, got %v", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: DialNet: %v", c.name, err)
+			continue
+		}
+		doTestCalls(t, p.Client, <-accepted)
+		p.Close()
+	}
+	if e, ok := last.(*RejectedError); !ok || e.Reason != "go away" {
+		t.Errorf("expected custom rejection reason, got %v", last)
+	}
+}
+
+func TestReconnectingClient(t *testing.T) {
+	defer func(d time.Duration) { MinRedialDelay = d }(MinRedialDelay)
+	MinRedialDelay = time.Millisecond
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	srv := rpc.NewServer()
+	srv.Register(new(Arith))
+	accepted := make(chan *rpc.Client, 1)
+	reg := new(Registry)
+	go (&Endpoint{Server: srv, Clients: accepted, Registry: reg}).Serve(l)
+
+	connects := make(chan *Peer, 2)
+	disconnects := make(chan error, 2)
+	rc := (&Endpoint{Server: srv}).DialReconnecting(NetDialer("tcp", l.Addr().String()),
+		func(p *Peer) { connects <- p },
+		func(p *Peer, err error) { disconnects <- err })
+
+	for i := 0; i < 2; i++ {
+		p := <-connects
+		if rc.Peer() != p {
+			t.Errorf("Peer returned %v, expected %v", rc.Peer(), p)
+		}
+		prod := Product{}
+		if err := rc.Call("Arith.Multiply", &Args{3, 5}, &prod); err != nil || prod.R != 15 {
+			t.Errorf("Call: %v, %v", prod, err)
+		}
+		doTestCalls(t, p.Client, <-accepted)
+
+		// break the connection from the accepting end
+		for reg.Len() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		reg.Each(func(p *Peer) { p.Close() })
+		if err := <-disconnects; err == nil {
+			t.Errorf("expected disconnection error")
+		}
+	}
+
+	<-connects
+	rc.Close()
+	<-disconnects
+	if err := rc.Call("Arith.Multiply", &Args{3, 5}, new(Product)); err != ErrClientClosed {
+		t.Errorf("expected %v, got %v", ErrClientClosed, err)
+	}
+}
+
+func TestReconnectingGo(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	var intercepted int32
+	e := &Endpoint{ClientInterceptors: []Interceptor{
+		func(c *Call, next func() error) error {
+			atomic.AddInt32(&intercepted, 1)
+			return next()
+		},
+	}}
+	rc := e.DialReconnecting(NetDialer("tcp", l.Addr().String()), nil, nil)
+	defer rc.Close()
+
+	// Go does not wait for the connection, which cannot complete until the
+	// other end serves it
+	returned := make(chan *rpc.Call)
+	prod := Product{}
+	go func() { returned <- rc.Go("Arith.Multiply", &Args{3, 5}, &prod, nil) }()
+	var call *rpc.Call
+	select {
+	case call = <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Go blocked while disconnected")
+	}
+	select {
+	case <-call.Done:
+		t.Fatalf("call done before connecting: %v", call.Error)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	srv := rpc.NewServer()
+	srv.Register(new(Arith))
+	go (&Endpoint{Server: srv}).Serve(l)
+	select {
+	case <-call.Done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call not done after connecting")
+	}
+	if call.Error != nil || prod.R != 15 {
+		t.Errorf("Go: %v, %v", prod, call.Error)
+	}
+	if n := atomic.LoadInt32(&intercepted); n != 1 {
+		t.Errorf("interceptor ran %d times, want 1", n)
+	}
+}
+
+type Waiter struct {
+	deadlines chan bool
+	done      chan error
+}
+
+// Wait blocks until the call is cancelled.
+func (w *Waiter) Wait(args *Args, reply *Product) error {
+	ctx := Context(args)
+	_, ok := ctx.Deadline()
+	w.deadlines <- ok
+	<-ctx.Done()
+	w.done <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestCallContext(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	w := &Waiter{make(chan bool, 1), make(chan error, 1)}
+	srv := rpc.NewServer()
+	srv.Register(new(Arith))
+	srv.Register(w)
+	go (&Endpoint{Server: srv}).Serve(l)
+	p, err := (&Endpoint{}).DialNet("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialNet: %v", err)
+	}
+	defer p.Close()
+
+	prod := Product{}
+	if err := p.CallContext(context.Background(), "Arith.Multiply", &Args{3, 5}, &prod); err != nil || prod.R != 15 {
+		t.Errorf("CallContext: %v, %v", prod, err)
+	}
+
+	// cancellation is sent to the peer
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		if <-w.deadlines {
+			t.Errorf("unexpected deadline")
+		}
+		cancel()
+	}()
+	if err := p.CallContext(ctx, "Waiter.Wait", &Args{}, &prod); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if err := <-w.done; err != context.Canceled {
+		t.Errorf("expected remote %v, got %v", context.Canceled, err)
+	}
+
+	// and so is the deadline
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.CallContext(ctx, "Waiter.Wait", &Args{}, &prod); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if !<-w.deadlines {
+		t.Errorf("deadline not propagated")
+	}
+	if err := <-w.done; err != context.DeadlineExceeded && err != context.Canceled {
+		t.Errorf("expected remote call to end, got %v", err)
+	}
+
+	// a nil reply is accepted, as by Client.Call
+	if err := p.CallContext(context.Background(), "Arith.Multiply", &Args{2, 5}, nil); err != nil {
+		t.Errorf("CallContext with nil reply: %v", err)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	ss := NewStreamServer()
+	ss.Handle("Count", func(st *Stream) error {
+		var args Args
+		if err := st.Recv(&args); err != nil {
+			return err
+		}
+		for i := args.A; i < args.B; i++ {
+			if err := st.Send(&Product{i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	ss.Handle("Sum", func(st *Stream) error {
+		sum := 0
+		for {
+			var p Product
+			err := st.Recv(&p)
+			if err == io.EOF {
+				return st.Send(&Product{sum})
+			}
+			if err != nil {
+				return err
+			}
+			if p.R < 0 {
+				return errors.New("negative")
+			}
+			sum += p.R
+		}
+	})
+	go (&Endpoint{Streams: ss}).Serve(l)
+	p, err := (&Endpoint{}).DialNet("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialNet: %v", err)
+	}
+	defer p.Close()
+
+	// stream of replies, more than fit in the flow control window
+	const n = 20000
+	st, err := p.OpenStream("Count")
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	if err := st.Send(&Args{0, n}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	i := 0
+	for {
+		var r Product
+		if err := st.Recv(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if r.R != i {
+			t.Fatalf("expected %d, got %d", i, r.R)
+		}
+		i++
+	}
+	if i != n {
+		t.Errorf("expected %d replies, got %d", n, i)
+	}
+	st.Close()
+
+	// stream of arguments
+	sum := func(vals ...int) (int, error) {
+		st, err := p.OpenStream("Sum")
+		if err != nil {
+			return 0, err
+		}
+		defer st.Close()
+		for _, v := range vals {
+			if err := st.Send(&Product{v}); err != nil {
+				return 0, err
+			}
+		}
+		st.CloseSend()
+		var r Product
+		err = st.Recv(&r)
+		return r.R, err
+	}
+	if r, err := sum(1, 2, 3, 4); err != nil || r != 10 {
+		t.Errorf("Sum: %d, %v", r, err)
+	}
+	if _, err := sum(1, -2, 3); err != rpc.ServerError("negative") {
+		t.Errorf("expected error from handler, got %v", err)
+	}
+
+	st, err = p.OpenStream("Nope")
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	if err := st.Recv(new(Product)); err == nil || err == io.EOF {
+		t.Errorf("expected error from unknown method, got %v", err)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	srv := rpc.NewServer()
+	srv.Register(new(Arith))
+	var serverStats, clientStats CallStats
+	var seen []string
+	var mu sync.Mutex
+	record := func(c *Call, next func() error) error {
+		err := next()
+		mu.Lock()
+		seen = append(seen, fmt.Sprintf("%s %v %v %v", c.Method, c.Server, c.Reply, err))
+		mu.Unlock()
+		return err
+	}
+	deny := func(c *Call, next func() error) error {
+		if c.Args.(*Args).A < 0 {
+			return errors.New("denied")
+		}
+		return next()
+	}
+	go (&Endpoint{
+		Server:             srv,
+		ServerInterceptors: []Interceptor{LogCalls, serverStats.Intercept, record, deny},
+	}).Serve(l)
+	p, err := (&Endpoint{
+		ClientInterceptors: []Interceptor{LogCalls, clientStats.Intercept},
+	}).DialNet("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialNet: %v", err)
+	}
+	defer p.Close()
+
+	prod := Product{}
+	if err := p.Call("Arith.Multiply", &Args{3, 5}, &prod); err != nil || prod.R != 15 {
+		t.Errorf("Call: %v, %v", prod, err)
+	}
+	if err := p.CallContext(context.Background(), "Arith.Divide", &Args{1, 0}, new(Quotient)); err == nil {
+		t.Errorf("expected divide by zero")
+	}
+	if err := p.Call("Arith.Multiply", &Args{-1, 5}, &prod); err != rpc.ServerError("denied") {
+		t.Errorf("expected denied, got %v", err)
+	}
+
+	for _, cs := range []map[string]MethodStats{serverStats.Stats(), clientStats.Stats()} {
+		if ms := cs["Arith.Multiply"]; ms.Calls != 2 || ms.Errors != 1 {
+			t.Errorf("bad Multiply stats %+v", ms)
+		}
+		if ms := cs["Arith.Divide"]; ms.Calls != 1 || ms.Errors != 1 {
+			t.Errorf("bad Divide stats %+v", ms)
+		}
+	}
+	mu.Lock()
+	if fmt.Sprint(seen) != "[Arith.Multiply true &{15} <nil> Arith.Divide true <nil> divide by zero Arith.Multiply true <nil> denied]" {
+		t.Errorf("interceptor saw %v", seen)
+	}
+	mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := serverStats.Varz(&buf); err != nil {
+		t.Fatalf("Varz: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Arith.Multiply.Calls=2\n") {
+		t.Errorf("bad varz:\n%s", buf.String())
+	}
+}
+
+type Panicker struct{}
+
+func (Panicker) Panic(args *Args, reply *Product) error {
+	panic(fmt.Sprint("boom ", args.A))
+}
+
+func (Panicker) Sleep(d time.Duration, reply *Product) error {
+	time.Sleep(d)
+	reply.R = 1
+	return nil
+}
+
+func TestRecover(t *testing.T) {
+	for _, codec := range []string{Gob, JSONRPC} {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		srv := rpc.NewServer()
+		if err := Register(srv, new(Arith)); err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+		if err := RegisterName(srv, "P", Panicker{}); err != nil {
+			t.Fatalf("RegisterName: %v", err)
+		}
+		var durations []time.Duration
+		var mu sync.Mutex
+		timer := func(c *Call, next func() error) error {
+			err := next()
+			mu.Lock()
+			durations = append(durations, c.Duration)
+			mu.Unlock()
+			return err
+		}
+		go (&Endpoint{Server: srv, ServerInterceptors: []Interceptor{timer}}).Serve(l)
+		p, err := (&Endpoint{Codec: codec}).DialNet("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("DialNet: %v", err)
+		}
+
+		err = p.Call("P.Panic", &Args{7, 0}, new(Product))
+		if err == nil || !strings.Contains(err.Error(), "panic in P.Panic: boom 7") {
+			t.Errorf("%s: expected panic error, got %v", codec, err)
+		}
+		prod := Product{}
+		if err := p.Call("P.Sleep", 20*time.Millisecond, &prod); err != nil || prod.R != 1 {
+			t.Errorf("%s: Sleep: %v, %v", codec, prod, err)
+		}
+		if err := p.Call("Arith.Multiply", &Args{3, 5}, &prod); err != nil || prod.R != 15 {
+			t.Errorf("%s: Multiply after panic: %v, %v", codec, prod, err)
+		}
+
+		mu.Lock()
+		if len(durations) != 3 || durations[1] < 20*time.Millisecond {
+			t.Errorf("%s: bad durations %v", codec, durations)
+		}
+		mu.Unlock()
+
+		// peers cannot call the dispatcher themselves
+		var x interface{} = "x"
+		if err := p.Call(dispatchMethod, &x, new(interface{})); err == nil {
+			t.Errorf("%s: dispatcher called directly", codec)
+		}
+		if err := p.Call("Arith.Multiply", &Args{3, 5}, &prod); err != nil || prod.R != 15 {
+			t.Errorf("%s: Multiply after dispatcher call: %v, %v", codec, prod, err)
+		}
+		p.Close()
+		l.Close()
+
+		// nor when the rpc.Server is served without birpc's codec
+		c0, c1 := net.Pipe()
+		go srv.ServeConn(c0)
+		client := rpc.NewClient(c1)
+		if err := client.Call(dispatchMethod, &x, new(interface{})); err == nil || err.Error() != errDispatch.Error() {
+			t.Errorf("%s: expected %v, got %v", codec, errDispatch, err)
+		}
+		client.Close()
+	}
+}
+
+func TestJSONRPC(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	srv := rpc.NewServer()
+	srv.Register(new(Arith))
+	accepted := make(chan *rpc.Client, 1)
+	go (&Endpoint{Server: srv, Clients: accepted}).Serve(l)
+
+	p, err := (&Endpoint{Server: srv, Codec: JSONRPC}).DialNet("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialNet: %v", err)
+	}
+	defer p.Close()
+	if p.Codec != JSONRPC {
+		t.Errorf("expected codec %s, got %s", JSONRPC, p.Codec)
+	}
+	doTestCalls(t, p.Client, <-accepted)
+	prod := Product{}
+	if err := p.CallContext(context.Background(), "Arith.Multiply", &Args{2, 5}, &prod); err != nil || prod.R != 10 {
+		t.Errorf("CallContext: %v, %v", prod, err)
+	}
+
+	_, err = (&Endpoint{Codec: "xml"}).DialNet("tcp", l.Addr().String())
+	if e, ok := err.(*UnsupportedCodecError); !ok || e.Codec != "xml" {
+		t.Errorf("expected unsupported codec to be rejected, got %v", err)
+	}
+}
+
+func TestPlainJSONRPC(t *testing.T) {
+	srv := rpc.NewServer()
+	srv.Register(new(Arith))
+	var calls int32
+	count := func(c *Call, next func() error) error {
+		atomic.AddInt32(&calls, 1)
+		return next()
+	}
+	hs := httptest.NewServer((&Endpoint{Server: srv, ServerInterceptors: []Interceptor{count}}).Handler())
+	defer hs.Close()
+	url := "ws" + strings.TrimPrefix(hs.URL, "http") + "/?codec=jsonrpc"
+
+	ws, err := websocket.Dial(url, "", hs.URL)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	if err := websocket.Message.Send(ws, `{"method":"Arith.Multiply","params":[{"A":3,"B":5}],"id":1}`); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	var msg string
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	var resp struct {
+		ID     int
+		Result Product
+		Error  interface{}
+	}
+	if err := json.Unmarshal([]byte(msg), &resp); err != nil {
+		t.Fatalf("Unmarshal %q: %v", msg, err)
+	}
+	if resp.ID != 1 || resp.Result.R != 15 || resp.Error != nil {
+		t.Errorf("bad response %q", msg)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected 1 intercepted call, got %d", n)
+	}
+
+	// plain peers cannot authenticate
+	auth := func(*Handshake) error { return nil }
+	hs2 := httptest.NewServer((&Endpoint{Server: srv, Auth: auth}).Handler())
+	defer hs2.Close()
+	ws2, err := websocket.Dial("ws"+strings.TrimPrefix(hs2.URL, "http")+"/?codec=jsonrpc", "", hs2.URL)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws2.Close()
+	websocket.Message.Send(ws2, `{"method":"Arith.Multiply","params":[{"A":3,"B":5}],"id":1}`)
+	if err := websocket.Message.Receive(ws2, &msg); err == nil {
+		t.Errorf("expected unauthenticated plain peer to be disconnected, got %q", msg)
+	}
+}
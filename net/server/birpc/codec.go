@@ -0,0 +1,148 @@
+package birpc
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/rpc"
+	"time"
+)
+
+// Codecs for the RPC streams of a connection. The dialing end requests one
+// in its Hello and the accepting end uses it for both RPC streams.
+//
+// The codec only encodes unary calls. Connections are still multiplexed
+// Sessions with a gob-encoded control stream, so both ends must use birpc
+// whichever codec is chosen; Endpoint.Handler also serves plain JSON-RPC to
+// peers that do not.
+const (
+	Gob     = "gob"     // the default, as used by net/rpc
+	JSONRPC = "jsonrpc" // JSON-RPC 1.0, as used by net/rpc/jsonrpc
+)
+
+// negotiate returns the codec to use for a connection whose dialing end
+// requested codec.
+func negotiate(codec string) (string, error) {
+	switch codec {
+	case "", Gob:
+		return Gob, nil
+	case JSONRPC:
+		return JSONRPC, nil
+	}
+	return "", &UnsupportedCodecError{codec}
+}
+
+// UnsupportedCodecError is returned by both ends of a connection when the
+// accepting end does not support the codec requested by the dialing end.
+type UnsupportedCodecError struct {
+	Codec string
+}
+
+func (e *UnsupportedCodecError) Error() string {
+	return fmt.Sprintf("govtil/net/server/birpc: unsupported codec %q", e.Codec)
+}
+
+// requestMeta accompanies each request in wire formats that carry it.
+type requestMeta struct {
+	Timeout time.Duration // zero if the call has no deadline
+}
+
+// clientWire and serverWire read and write requests in one wire format.
+type clientWire interface {
+	WriteRequest(*rpc.Request, *requestMeta, interface{}) error
+	ReadResponseHeader(*rpc.Response) error
+	ReadResponseBody(interface{}) error
+	Close() error
+}
+
+type serverWire interface {
+	ReadRequestHeader(*rpc.Request, *requestMeta) error
+	ReadRequestBody(interface{}) error
+	WriteResponse(*rpc.Response, interface{}) error
+	Close() error
+}
+
+// The gob wire format is that of net/rpc, except that each rpc.Request is
+// followed by a requestMeta.
+
+type gobWire struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newGobWire(rwc io.ReadWriteCloser) *gobWire {
+	buf := bufio.NewWriter(rwc)
+	return &gobWire{rwc, gob.NewDecoder(rwc), gob.NewEncoder(buf), buf}
+}
+
+func (w *gobWire) write(vs ...interface{}) error {
+	for _, v := range vs {
+		if err := w.enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	return w.encBuf.Flush()
+}
+
+func (w *gobWire) Close() error {
+	return w.rwc.Close()
+}
+
+type gobClientWire struct{ *gobWire }
+
+func newGobClientWire(rwc io.ReadWriteCloser) gobClientWire {
+	return gobClientWire{newGobWire(rwc)}
+}
+
+func (w gobClientWire) WriteRequest(r *rpc.Request, m *requestMeta, body interface{}) error {
+	return w.write(r, m, body)
+}
+
+func (w gobClientWire) ReadResponseHeader(r *rpc.Response) error {
+	return w.dec.Decode(r)
+}
+
+func (w gobClientWire) ReadResponseBody(body interface{}) error {
+	return w.dec.Decode(body)
+}
+
+type gobServerWire struct{ *gobWire }
+
+func newGobServerWire(rwc io.ReadWriteCloser) gobServerWire {
+	return gobServerWire{newGobWire(rwc)}
+}
+
+func (w gobServerWire) ReadRequestHeader(r *rpc.Request, m *requestMeta) error {
+	if err := w.dec.Decode(r); err != nil {
+		return err
+	}
+	return w.dec.Decode(m)
+}
+
+func (w gobServerWire) ReadRequestBody(body interface{}) error {
+	return w.dec.Decode(body)
+}
+
+func (w gobServerWire) WriteResponse(r *rpc.Response, body interface{}) error {
+	return w.write(r, body)
+}
+
+// The JSON-RPC wire format is that of net/rpc/jsonrpc, so that calls and
+// their replies are JSON on the RPC streams. It carries no requestMeta, so
+// calls made with CallContext over it are neither given a deadline nor
+// cancelled on the peer.
+
+type jsonClientWire struct{ rpc.ClientCodec }
+
+func (w jsonClientWire) WriteRequest(r *rpc.Request, _ *requestMeta, body interface{}) error {
+	return w.ClientCodec.WriteRequest(r, body)
+}
+
+type jsonServerWire struct{ rpc.ServerCodec }
+
+func (w jsonServerWire) ReadRequestHeader(r *rpc.Request, _ *requestMeta) error {
+	return w.ServerCodec.ReadRequestHeader(r)
+}
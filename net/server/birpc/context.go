@@ -0,0 +1,374 @@
+package birpc
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/vsekhar/govtil/log"
+)
+
+// Calls made with CallContext are cancelled by sending a controlMsg on the
+// control stream.
+
+type controlMsg struct {
+	Cancel uint64 // sequence number of a call
+}
+
+// ctxArgs wraps the arguments of a call made with CallContext so that the
+// client codec can find its deadline and record its sequence number.
+type ctxArgs struct {
+	ctx  context.Context
+	args interface{}
+	seq  uint64
+	sent bool
+}
+
+// clientCodec records the sequence numbers of calls made with CallContext
+// and passes their deadlines to the wire format.
+// It also counts calls by method.
+type clientCodec struct {
+	clientWire
+	meta bool // whether the wire format carries requestMeta to the peer
+
+	stats   CallStats
+	mu      sync.Mutex
+	pending map[uint64]pendingCall
+}
+
+type pendingCall struct {
+	method string
+	start  time.Time
+}
+
+func newClientCodec(codec string, rwc io.ReadWriteCloser) *clientCodec {
+	c := &clientCodec{pending: make(map[uint64]pendingCall)}
+	if codec == JSONRPC {
+		c.clientWire = jsonClientWire{jsonrpc.NewClientCodec(rwc)}
+	} else {
+		c.clientWire, c.meta = newGobClientWire(rwc), true
+	}
+	return c
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	var m requestMeta
+	if a, ok := body.(*ctxArgs); ok {
+		a.seq, a.sent = r.Seq, c.meta
+		if d, ok := a.ctx.Deadline(); ok {
+			if m.Timeout = time.Until(d); m.Timeout <= 0 {
+				m.Timeout = 1
+			}
+		}
+		body = a.args
+	}
+	pc := pendingCall{r.ServiceMethod, time.Now()}
+	c.mu.Lock()
+	c.pending[r.Seq] = pc
+	c.mu.Unlock()
+	err := c.clientWire.WriteRequest(r, &m, body)
+	if err != nil {
+		c.done(r.Seq, err)
+	}
+	return err
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	if err := c.clientWire.ReadResponseHeader(r); err != nil {
+		return err
+	}
+	var err error
+	if r.Error != "" {
+		err = rpc.ServerError(r.Error)
+	}
+	c.done(r.Seq, err)
+	return nil
+}
+
+// done records the outcome of call seq.
+func (c *clientCodec) done(seq uint64, err error) {
+	c.mu.Lock()
+	pc, ok := c.pending[seq]
+	delete(c.pending, seq)
+	c.mu.Unlock()
+	if ok {
+		c.stats.record(pc.method, time.Since(pc.start), err)
+	}
+}
+
+func (c *clientCodec) inFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// serverCall is a call being served, with the context returned by Context.
+type serverCall struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	start  time.Time
+	method string
+	args   interface{}
+	ic     *intercepted   // nil if there are no Interceptors
+	rm     *recoverMethod // nil unless registered with Register
+}
+
+// serverCodec tracks the calls being served, providing their contexts,
+// running them through Interceptors and counting them by method.
+type serverCodec struct {
+	wire serverWire
+	srv  *rpc.Server
+
+	interceptors []Interceptor
+	peer         *Peer
+	stats        CallStats
+
+	mu    sync.Mutex
+	calls map[uint64]*serverCall
+	cur   *serverCall // call whose body is read next
+}
+
+func newServerCodec(codec string, rwc io.ReadWriteCloser, srv *rpc.Server, interceptors []Interceptor) *serverCodec {
+	var wire serverWire
+	if codec == JSONRPC {
+		wire = jsonServerWire{jsonrpc.NewServerCodec(rwc)}
+	} else {
+		wire = newGobServerWire(rwc)
+	}
+	return &serverCodec{
+		wire:         wire,
+		srv:          srv,
+		interceptors: interceptors,
+		calls:        make(map[uint64]*serverCall),
+	}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	var m requestMeta
+	if err := c.wire.ReadRequestHeader(r, &m); err != nil {
+		return err
+	}
+	call := &serverCall{start: time.Now(), method: r.ServiceMethod}
+	if r.ServiceMethod == dispatchMethod {
+		// only the codec may dispatch; net/rpc reports the method unknown
+		r.ServiceMethod = dispatchName + ".reserved"
+	} else if call.rm = recovered(c.srv, r.ServiceMethod); call.rm != nil {
+		r.ServiceMethod = dispatchMethod
+	}
+	if m.Timeout > 0 {
+		call.ctx, call.cancel = context.WithTimeout(context.Background(), m.Timeout)
+	} else {
+		call.ctx, call.cancel = context.WithCancel(context.Background())
+	}
+	c.mu.Lock()
+	c.calls[r.Seq] = call
+	c.cur = call
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	c.mu.Lock()
+	call := c.cur
+	c.cur = nil
+	c.mu.Unlock()
+	if call != nil && call.rm != nil && body != nil {
+		// decode the method's own arguments and dispatch them
+		v, arg := call.rm.newArgs()
+		if err := c.wire.ReadRequestBody(v.Interface()); err != nil {
+			return err
+		}
+		*body.(*interface{}) = &dispatched{rm: call.rm, args: arg}
+		body = v.Interface()
+	} else if err := c.wire.ReadRequestBody(body); err != nil {
+		return err
+	}
+	if body == nil || call == nil {
+		return nil
+	}
+	call.args = body
+	contexts.set(body, call.ctx)
+	if len(c.interceptors) == 0 {
+		return nil
+	}
+	// an error returned here fails the call without calling the method
+	ic, err := c.intercept(call.method, body)
+	call.ic = ic
+	return err
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mu.Lock()
+	call := c.calls[r.Seq]
+	delete(c.calls, r.Seq)
+	c.mu.Unlock()
+	if call != nil {
+		call.cancel()
+		if call.rm != nil {
+			r.ServiceMethod = call.method
+			if b, ok := body.(*interface{}); ok {
+				body = *b
+			}
+		}
+		if call.args != nil {
+			contexts.remove(call.args)
+		}
+		if call.ic != nil {
+			if err := call.ic.finish(body, r.Error); err != nil {
+				r.Error = err.Error()
+			}
+		}
+		var err error
+		if r.Error != "" {
+			err = rpc.ServerError(r.Error)
+		}
+		c.stats.record(call.method, time.Since(call.start), err)
+	}
+
+	return c.wire.WriteResponse(r, body)
+}
+
+func (c *serverCodec) inFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.calls)
+}
+
+// cancelCall cancels the context of the call with sequence number seq.
+func (c *serverCodec) cancelCall(seq uint64) {
+	c.mu.Lock()
+	call := c.calls[seq]
+	c.mu.Unlock()
+	if call != nil {
+		call.cancel()
+	}
+}
+
+func (c *serverCodec) Close() error {
+	c.mu.Lock()
+	for _, call := range c.calls {
+		call.cancel()
+	}
+	c.mu.Unlock()
+	return c.wire.Close()
+}
+
+// contexts maps the arguments of calls being served to their contexts.
+var contexts = &contextMap{m: make(map[interface{}]context.Context)}
+
+type contextMap struct {
+	mu sync.Mutex
+	m  map[interface{}]context.Context
+}
+
+func (cm *contextMap) set(args interface{}, ctx context.Context) {
+	cm.mu.Lock()
+	cm.m[args] = ctx
+	cm.mu.Unlock()
+}
+
+func (cm *contextMap) remove(args interface{}) {
+	cm.mu.Lock()
+	delete(cm.m, args)
+	cm.mu.Unlock()
+}
+
+// Context returns the context of a call being served over birpc, given the
+// arguments the method was called with. The context is cancelled when the
+// caller cancels the call, when its deadline passes, when the connection is
+// closed, or when the method returns. Methods must take their arguments as a
+// pointer for Context to find them; otherwise context.Background() is
+// returned.
+//
+//	func (t *Arith) Slow(args *Args, reply *Reply) error {
+//		select {
+//		case <-time.After(time.Minute):
+//		case <-birpc.Context(args).Done():
+//			return birpc.Context(args).Err()
+//		}
+//		...
+//	}
+func Context(args interface{}) context.Context {
+	contexts.mu.Lock()
+	defer contexts.mu.Unlock()
+	if ctx, ok := contexts.m[args]; ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+// control reads control messages from the peer until the connection is
+// closed.
+func (p *Peer) control(dec *gob.Decoder) {
+	for {
+		var m controlMsg
+		if err := dec.Decode(&m); err != nil {
+			return
+		}
+		p.server.cancelCall(m.Cancel)
+	}
+}
+
+// CallContext calls method on the peer like Client.Call, but stops waiting
+// when ctx is done, returning ctx.Err(). The peer is told to cancel the call
+// and any deadline of ctx is passed to the peer; see Context.
+//
+// reply is only written to if the call succeeds.
+func (p *Peer) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c := &Call{Method: method, Args: args, Reply: reply, Peer: p}
+	return chain(p.interceptors, c, func() error {
+		return p.callContext(ctx, method, args, reply)
+	})
+}
+
+func (p *Peer) callContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	// The reply of an abandoned call may still arrive, so it is decoded into
+	// a copy. Replies that cannot be written to, such as nil, are passed
+	// through as they are.
+	rv := reflect.ValueOf(reply)
+	copied := rv.Kind() == reflect.Ptr && !rv.IsNil()
+	r := reply
+	if copied {
+		r = reflect.New(rv.Type().Elem()).Interface()
+	}
+	a := &ctxArgs{ctx: ctx, args: args}
+	call := p.Client.Go(method, a, r, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == nil && copied {
+			rv.Elem().Set(reflect.ValueOf(r).Elem())
+		}
+		return call.Error
+	case <-ctx.Done():
+	}
+	if a.sent {
+		p.ctlMu.Lock()
+		err := p.ctl.Encode(&controlMsg{Cancel: a.seq})
+		p.ctlMu.Unlock()
+		if err != nil {
+			log.Debugf("govtil/net/server/birpc: failed to cancel call %d: %v", a.seq, err)
+		}
+	}
+	return ctx.Err()
+}
+
+// CallContext is like Peer.CallContext, and waits for a connection if there
+// is none until ctx is done.
+func (rc *ReconnectingClient) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	p, err := rc.wait(ctx.Done())
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return ctx.Err()
+	}
+	return p.CallContext(ctx, method, args, reply)
+}
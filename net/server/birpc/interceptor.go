@@ -0,0 +1,142 @@
+package birpc
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"time"
+
+	"github.com/vsekhar/govtil/log"
+)
+
+// Call describes a unary call seen by an Interceptor.
+type Call struct {
+	Method string // e.g. "Arith.Multiply"
+	Args   interface{}
+	Reply  interface{} // on the serving end, set once next returns nil
+	Peer   *Peer
+	Server bool // true on the serving end of the call
+
+	// Duration of the call, set once next returns. On the serving end it
+	// is the time taken by the method.
+	Duration time.Duration
+}
+
+// An Interceptor runs around unary calls, e.g. to log them, record metrics
+// or check them against an access policy. It continues the call by calling
+// next, which returns the error of the call, and returns that error or
+// another one. If it returns without calling next, the call is not made and
+// fails with the Interceptor's error.
+//
+// On the serving end, Interceptors run around the methods of the Endpoint's
+// Server, and an error they return replaces the method's. The rest of the
+// connection is not read until each Interceptor has called next or returned,
+// so they should not block before calling next.
+//
+// On the calling end, Interceptors run around calls made with Peer.Call and
+// Peer.CallContext, but not those made directly with Peer.Client.
+//
+// net/rpc calls methods on goroutines of its own, so an Interceptor cannot
+// recover from panics in them. Register receivers with Register to have
+// panics returned as errors instead.
+type Interceptor func(c *Call, next func() error) error
+
+// chain runs c through is and then final.
+func chain(is []Interceptor, c *Call, final func() error) error {
+	if len(is) == 0 {
+		start := time.Now()
+		err := final()
+		c.Duration = time.Since(start)
+		return err
+	}
+	return is[0](c, func() error {
+		return chain(is[1:], c, final)
+	})
+}
+
+// intercepted is the state of a served call running through Interceptors.
+type intercepted struct {
+	c       *Call
+	proceed chan error // the method may be called if nil is sent
+	result  chan error // the method's error
+	final   chan error // the error returned by the Interceptors
+}
+
+// intercept runs call through the serving end's Interceptors on another
+// goroutine, returning once they have called next or failed the call.
+func (c *serverCodec) intercept(method string, args interface{}) (*intercepted, error) {
+	ic := &intercepted{
+		c:       &Call{Method: method, Args: args, Peer: c.peer, Server: true},
+		proceed: make(chan error, 1),
+		result:  make(chan error, 1),
+		final:   make(chan error, 1),
+	}
+	go func() {
+		called := false
+		err := chain(c.interceptors, ic.c, func() error {
+			called = true
+			ic.proceed <- nil
+			return <-ic.result
+		})
+		if !called {
+			if err == nil {
+				err = errors.New("govtil/net/server/birpc: call dropped by interceptor")
+			}
+			ic.proceed <- err
+			return
+		}
+		ic.final <- err
+	}()
+	if err := <-ic.proceed; err != nil {
+		return nil, err
+	}
+	return ic, nil
+}
+
+// finish passes the method's reply and error back through the Interceptors
+// and returns the error they return.
+func (ic *intercepted) finish(reply interface{}, errmsg string) error {
+	var err error
+	if errmsg != "" {
+		// net/rpc sends a placeholder in place of the reply
+		err = rpc.ServerError(errmsg)
+	} else {
+		ic.c.Reply = reply
+	}
+	ic.result <- err
+	return <-ic.final
+}
+
+// Call calls method on the peer like Client.Call, through the Endpoint's
+// ClientInterceptors.
+func (p *Peer) Call(method string, args interface{}, reply interface{}) error {
+	c := &Call{Method: method, Args: args, Reply: reply, Peer: p}
+	return chain(p.interceptors, c, func() error {
+		return p.Client.Call(method, args, reply)
+	})
+}
+
+func (p *Peer) String() string {
+	if p.Name == "" {
+		return fmt.Sprint(p.RemoteAddr)
+	}
+	return fmt.Sprintf("%s (%v)", p.Name, p.RemoteAddr)
+}
+
+// LogCalls is an Interceptor that logs each call with its duration through
+// govtil/log. Failed calls are logged at normal verbosity, others only at
+// debug verbosity.
+func LogCalls(c *Call, next func() error) error {
+	err := next()
+	d := c.Duration
+	dir := "to"
+	if c.Server {
+		dir = "from"
+	}
+	if err != nil {
+		log.Printf("govtil/net/server/birpc: call %s %v: %s failed after %v: %v", dir, c.Peer, c.Method, d, err)
+	} else {
+		log.Debugf("govtil/net/server/birpc: call %s %v: %s took %v", dir, c.Peer, c.Method, d)
+	}
+	return err
+}
@@ -0,0 +1,231 @@
+package birpc
+
+import (
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/vsekhar/govtil/log"
+)
+
+// Delays between attempts to reconnect a ReconnectingClient. Each failed
+// attempt doubles the delay, up to MaxRedialDelay, and each delay is
+// randomized by up to half its length so that many clients do not redial in
+// step.
+var (
+	MinRedialDelay = 100 * time.Millisecond
+	MaxRedialDelay = 30 * time.Second
+)
+
+// ErrClientClosed is returned by calls on a ReconnectingClient that has been
+// closed.
+var ErrClientClosed = errors.New("govtil/net/server/birpc: client closed")
+
+// WebsocketDialer returns a dial function for DialReconnecting that connects
+// to a websocket Handler at url.
+func WebsocketDialer(url string) func() (net.Conn, error) {
+	return WebsocketTLSDialer(url, nil)
+}
+
+// WebsocketTLSDialer is the same as WebsocketDialer except it uses config
+// for wss:// URLs.
+func WebsocketTLSDialer(url string, config *tls.Config) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return dialWebsocket(url, config)
+	}
+}
+
+// NetDialer returns a dial function for DialReconnecting that connects to a
+// listener passed to Serve.
+func NetDialer(network, addr string) func() (net.Conn, error) {
+	return TLSDialer(network, addr, nil)
+}
+
+// TLSDialer is the same as NetDialer except it connects over TLS using
+// config, unless config is nil.
+func TLSDialer(network, addr string, config *tls.Config) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return dialNet(network, addr, config)
+	}
+}
+
+// ReconnectingClient calls a peer over connections obtained from a dial
+// function, redialing whenever the connection is lost. The Endpoint's Server
+// is served to the peer on each new connection.
+type ReconnectingClient struct {
+	onConnect    func(*Peer)
+	onDisconnect func(*Peer, error)
+
+	e    *Endpoint
+	dial func() (net.Conn, error)
+
+	mu        sync.Mutex
+	peer      *Peer
+	connected chan struct{} // closed while peer is set
+	die       chan struct{}
+	closed    bool
+}
+
+// DialReconnecting returns a ReconnectingClient that connects using dial,
+// e.g. WebsocketDialer or NetDialer. Unlike Dial, it returns immediately and
+// keeps trying to connect in the background.
+//
+// If not nil, onConnect is called with each new connection before calls are
+// made on it, and onDisconnect is called with the peer and the reason each
+// time a connection is lost.
+func (e *Endpoint) DialReconnecting(dial func() (net.Conn, error), onConnect func(*Peer), onDisconnect func(*Peer, error)) *ReconnectingClient {
+	rc := &ReconnectingClient{
+		onConnect:    onConnect,
+		onDisconnect: onDisconnect,
+		e:            e,
+		dial:         dial,
+		connected:    make(chan struct{}),
+		die:          make(chan struct{}),
+	}
+	go rc.run()
+	return rc
+}
+
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (rc *ReconnectingClient) connect() (*Peer, error) {
+	c, err := rc.dial()
+	if err != nil {
+		return nil, err
+	}
+	return rc.e.connect(c, dialerServer, acceptorServer)
+}
+
+func (rc *ReconnectingClient) run() {
+	delay := MinRedialDelay
+	for {
+		p, err := rc.connect()
+		if err != nil {
+			log.Printf("govtil/net/server/birpc: failed to connect: %v", err)
+			select {
+			case <-time.After(jitter(delay)):
+			case <-rc.die:
+				return
+			}
+			if delay *= 2; delay > MaxRedialDelay {
+				delay = MaxRedialDelay
+			}
+			continue
+		}
+		delay = MinRedialDelay
+
+		rc.mu.Lock()
+		if rc.closed {
+			rc.mu.Unlock()
+			p.Close()
+			return
+		}
+		rc.mu.Unlock()
+		if rc.onConnect != nil {
+			rc.onConnect(p)
+		}
+		rc.mu.Lock()
+		rc.peer = p
+		close(rc.connected)
+		rc.mu.Unlock()
+
+		select {
+		case <-p.Done():
+		case <-rc.die:
+			p.Close()
+		}
+
+		rc.mu.Lock()
+		rc.peer = nil
+		rc.connected = make(chan struct{})
+		closed := rc.closed
+		rc.mu.Unlock()
+		if rc.onDisconnect != nil {
+			rc.onDisconnect(p, p.Err())
+		}
+		if closed {
+			return
+		}
+		log.Printf("govtil/net/server/birpc: connection to %v lost: %v", p.RemoteAddr, p.Err())
+	}
+}
+
+// Peer returns the currently connected peer, or nil if there is none.
+func (rc *ReconnectingClient) Peer() *Peer {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.peer
+}
+
+// wait waits for a connection until cancel is closed, in which case it
+// returns a nil Peer.
+func (rc *ReconnectingClient) wait(cancel <-chan struct{}) (*Peer, error) {
+	for {
+		rc.mu.Lock()
+		p, connected, closed := rc.peer, rc.connected, rc.closed
+		rc.mu.Unlock()
+		if closed {
+			return nil, ErrClientClosed
+		}
+		if p != nil {
+			return p, nil
+		}
+		select {
+		case <-connected:
+		case <-rc.die:
+		case <-cancel:
+			return nil, nil
+		}
+	}
+}
+
+// Call calls method on the peer, waiting for a connection if there is none.
+// Calls are not retried: a call in progress when the connection is lost
+// fails with rpc.ErrShutdown.
+func (rc *ReconnectingClient) Call(method string, args interface{}, reply interface{}) error {
+	p, err := rc.wait(nil)
+	if err != nil {
+		return err
+	}
+	return p.Call(method, args, reply)
+}
+
+// Go is the asynchronous version of Call. It returns at once, waiting for a
+// connection in the background, and sends the call on done once it is
+// complete. As for rpc.Client.Go, done must be buffered, and if it is nil a
+// new channel is allocated.
+func (rc *ReconnectingClient) Go(method string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	if done == nil {
+		done = make(chan *rpc.Call, 10)
+	} else if cap(done) == 0 {
+		panic("govtil/net/server/birpc: done channel is unbuffered")
+	}
+	call := &rpc.Call{ServiceMethod: method, Args: args, Reply: reply, Done: done}
+	go func() {
+		call.Error = rc.Call(method, args, reply)
+		select {
+		case done <- call:
+		default:
+			log.Debugf("govtil/net/server/birpc: discarding reply of %s, done channel is full", method)
+		}
+	}()
+	return call
+}
+
+// Close closes the current connection, if any, and stops redialing.
+func (rc *ReconnectingClient) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return ErrClientClosed
+	}
+	rc.closed = true
+	close(rc.die)
+	return nil
+}
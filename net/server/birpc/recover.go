@@ -0,0 +1,141 @@
+package birpc
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"reflect"
+	"runtime/debug"
+	"sync"
+
+	"github.com/vsekhar/govtil/log"
+)
+
+// net/rpc calls methods on goroutines of its own, where a panic cannot be
+// recovered by the caller. Methods of receivers registered with Register are
+// instead served through dispatchService: the server codec renames their
+// calls to dispatchMethod, decodes their arguments itself and hands them to
+// dispatchService.Call, which calls the method and recovers. Peers cannot
+// call dispatchMethod themselves: the codec refuses it, and Call checks that
+// its arguments came from the codec in case the rpc.Server is also served
+// some other way.
+
+const (
+	dispatchName   = "govtil/birpc"
+	dispatchMethod = dispatchName + ".Call"
+)
+
+// recoverMethod is a method of a receiver registered with Register.
+type recoverMethod struct {
+	name string // e.g. "Arith.Multiply"
+	rcvr reflect.Value
+	m    reflect.Method
+}
+
+// dispatched is a call to a recoverMethod, passed to dispatchService.Call as
+// its arguments.
+type dispatched struct {
+	rm   *recoverMethod
+	args reflect.Value // as passed to the method
+}
+
+type dispatchService struct{}
+
+// Call calls the method of a dispatched call, returning a panic in it as an
+// error.
+func (dispatchService) Call(args *interface{}, reply *interface{}) (err error) {
+	d, ok := (*args).(*dispatched)
+	if !ok {
+		return errDispatch
+	}
+	rt := d.rm.m.Type.In(2).Elem()
+	r := reflect.New(rt)
+	switch rt.Kind() {
+	case reflect.Map:
+		r.Elem().Set(reflect.MakeMap(rt))
+	case reflect.Slice:
+		r.Elem().Set(reflect.MakeSlice(rt, 0, 0))
+	}
+	*reply = r.Interface()
+	defer func() {
+		if p := recover(); p != nil {
+			log.Errorf("govtil/net/server/birpc: panic in %s: %v\n%s", d.rm.name, p, debug.Stack())
+			err = fmt.Errorf("govtil/net/server/birpc: panic in %s: %v", d.rm.name, p)
+		}
+	}()
+	out := d.rm.m.Func.Call([]reflect.Value{d.rm.rcvr, d.args, r})
+	if e := out[0].Interface(); e != nil {
+		return e.(error)
+	}
+	return nil
+}
+
+var errDispatch = errors.New("govtil/net/server/birpc: " + dispatchMethod + " cannot be called by peers")
+
+// recovering maps rpc.Servers to the methods registered with them through
+// Register, by name.
+var recovering = struct {
+	sync.Mutex
+	m map[*rpc.Server]map[string]*recoverMethod
+}{m: make(map[*rpc.Server]map[string]*recoverMethod)}
+
+// Register registers rcvr with srv like srv.Register, except that when its
+// methods are served over birpc a panic in one of them fails the call with
+// an error rather than crashing the process. The panic is logged with its
+// stack.
+func Register(srv *rpc.Server, rcvr interface{}) error {
+	return RegisterName(srv, "", rcvr)
+}
+
+// RegisterName is like Register, but uses name for the service, as
+// rpc.Server.RegisterName does.
+func RegisterName(srv *rpc.Server, name string, rcvr interface{}) error {
+	var err error
+	if name == "" {
+		err = srv.Register(rcvr)
+	} else {
+		err = srv.RegisterName(name, rcvr)
+	}
+	if err != nil {
+		return err
+	}
+	s := Describe(name, rcvr)
+	t := reflect.TypeOf(rcvr)
+
+	recovering.Lock()
+	defer recovering.Unlock()
+	methods := recovering.m[srv]
+	if methods == nil {
+		if err := srv.RegisterName(dispatchName, dispatchService{}); err != nil {
+			return err
+		}
+		methods = make(map[string]*recoverMethod)
+		recovering.m[srv] = methods
+	}
+	for _, m := range s.Methods {
+		rm := &recoverMethod{name: s.Name + "." + m.Name, rcvr: reflect.ValueOf(rcvr)}
+		rm.m, _ = t.MethodByName(m.Name)
+		methods[rm.name] = rm
+	}
+	return nil
+}
+
+// recovered returns the method registered with srv through Register as
+// name, or nil.
+func recovered(srv *rpc.Server, name string) *recoverMethod {
+	recovering.Lock()
+	defer recovering.Unlock()
+	return recovering.m[srv][name]
+}
+
+// newArgs returns a new value to decode the arguments of rm into, and the
+// value to pass to the method.
+func (rm *recoverMethod) newArgs() (decode, arg reflect.Value) {
+	at := rm.m.Type.In(1)
+	if at.Kind() == reflect.Ptr {
+		v := reflect.New(at.Elem())
+		return v, v
+	}
+	v := reflect.New(at)
+	return v, v.Elem()
+}
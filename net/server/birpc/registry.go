@@ -0,0 +1,147 @@
+package birpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/vsekhar/govtil/log"
+)
+
+// Registry records connected peers. The zero value is an empty Registry.
+type Registry struct {
+	mu    sync.RWMutex
+	next  uint64
+	peers map[uint64]*Peer
+	empty chan struct{} // closed while there are no peers, nil until needed
+}
+
+func (r *Registry) add(p *Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peers == nil {
+		r.peers = make(map[uint64]*Peer)
+	}
+	r.next++
+	p.ID = r.next
+	r.peers[p.ID] = p
+	if r.empty != nil && len(r.peers) == 1 {
+		r.empty = make(chan struct{})
+	}
+	log.Debugf("govtil/net/server/birpc: peer %d (%s) connected from %v", p.ID, p.Name, p.RemoteAddr)
+}
+
+func (r *Registry) remove(p *Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.peers[p.ID]; !ok {
+		return
+	}
+	delete(r.peers, p.ID)
+	if r.empty != nil && len(r.peers) == 0 {
+		close(r.empty)
+	}
+	log.Debugf("govtil/net/server/birpc: peer %d (%s) disconnected", p.ID, p.Name)
+}
+
+// Get returns the peer with the given ID, or nil if it is not connected.
+func (r *Registry) Get(id uint64) *Peer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.peers[id]
+}
+
+// Lookup returns a connected peer with the given name, or nil if there is
+// none. If several peers share the name, the most recently connected one is
+// returned.
+func (r *Registry) Lookup(name string) *Peer {
+	var found *Peer
+	r.Each(func(p *Peer) {
+		if p.Name == name {
+			found = p
+		}
+	})
+	return found
+}
+
+// Len returns the number of connected peers.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.peers)
+}
+
+// Empty returns a channel that is closed once no peers are connected. If
+// none are connected, the channel is already closed.
+func (r *Registry) Empty() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.empty == nil {
+		r.empty = make(chan struct{})
+		if len(r.peers) == 0 {
+			close(r.empty)
+		}
+	}
+	return r.empty
+}
+
+// Peers returns the connected peers in the order they connected.
+func (r *Registry) Peers() []*Peer {
+	r.mu.RLock()
+	ps := make([]*Peer, 0, len(r.peers))
+	for _, p := range r.peers {
+		ps = append(ps, p)
+	}
+	r.mu.RUnlock()
+	sort.Sort(byID(ps))
+	return ps
+}
+
+type byID []*Peer
+
+func (b byID) Len() int           { return len(b) }
+func (b byID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byID) Less(i, j int) bool { return b[i].ID < b[j].ID }
+
+// Each calls f for each connected peer in the order they connected. Peers
+// that connect or disconnect while Each is running may or may not be seen.
+func (r *Registry) Each(f func(*Peer)) {
+	for _, p := range r.Peers() {
+		f(p)
+	}
+}
+
+// Result is the outcome of a call to one peer in a Broadcast.
+type Result struct {
+	Peer  *Peer
+	Reply interface{} // a new value of the type of the reply passed to Broadcast
+	Error error
+}
+
+// Broadcast calls method on every connected peer in parallel with
+// Peer.CallContext, so client interceptors run and each call is abandoned
+// once ctx is done, and waits for all of them to finish. reply must be a
+// non-nil pointer; it is not written to, but a new value of the same type is
+// allocated for each peer. Results are in the order the peers connected.
+func (r *Registry) Broadcast(ctx context.Context, method string, args interface{}, reply interface{}) ([]Result, error) {
+	rv := reflect.ValueOf(reply)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return nil, fmt.Errorf("govtil/net/server/birpc: Broadcast reply must be a non-nil pointer, got %T", reply)
+	}
+	t := rv.Type().Elem()
+	peers := r.Peers()
+	results := make([]Result, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		results[i] = Result{Peer: p, Reply: reflect.New(t).Interface()}
+		wg.Add(1)
+		go func(res *Result) {
+			defer wg.Done()
+			res.Error = res.Peer.CallContext(ctx, method, args, res.Reply)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results, nil
+}
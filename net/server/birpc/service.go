@@ -0,0 +1,76 @@
+package birpc
+
+import (
+	"reflect"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Service describes a receiver registered with an rpc.Server.
+type Service struct {
+	Name    string
+	Methods []Method
+}
+
+// Method describes a method of a Service.
+type Method struct {
+	Name  string // e.g. "Multiply"
+	Args  string // type of the arguments, e.g. "*Args"
+	Reply string // type of the reply, e.g. "*Product"
+}
+
+// Describe returns the Service that rpc.Server.RegisterName(name, rcvr)
+// would register, or that rpc.Server.Register(rcvr) would if name is empty.
+// rpc.Server cannot list what has been registered with it, so servers that
+// want to show their services, e.g. on /rpcz, describe them as they
+// register them.
+func Describe(name string, rcvr interface{}) Service {
+	t := reflect.TypeOf(rcvr)
+	if name == "" {
+		name = reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name()
+	}
+	s := Service{Name: name}
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if !servable(m) {
+			continue
+		}
+		s.Methods = append(s.Methods, Method{
+			Name:  m.Name,
+			Args:  m.Type.In(1).String(),
+			Reply: m.Type.In(2).String(),
+		})
+	}
+	sort.Sort(byName(s.Methods))
+	return s
+}
+
+type byName []Method
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+// servable reports whether net/rpc serves m, following the rules of
+// rpc.Server.Register.
+func servable(m reflect.Method) bool {
+	mt := m.Type
+	if m.PkgPath != "" || mt.NumIn() != 3 || mt.NumOut() != 1 {
+		return false
+	}
+	args, reply := mt.In(1), mt.In(2)
+	return exportedOrBuiltin(args) &&
+		reply.Kind() == reflect.Ptr && exportedOrBuiltin(reply) &&
+		mt.Out(0) == typeOfError
+}
+
+func exportedOrBuiltin(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	r, _ := utf8.DecodeRuneInString(t.Name())
+	return unicode.IsUpper(r) || t.PkgPath() == ""
+}
@@ -0,0 +1,177 @@
+package birpc
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vsekhar/govtil/net/server/varz"
+)
+
+// Call durations are counted in buckets whose bounds grow by a factor of
+// sqrt(2), from 1µs up to about 70 minutes.
+const (
+	numBuckets = 64
+	bucketBase = time.Microsecond
+)
+
+func bucket(d time.Duration) int {
+	if d <= bucketBase {
+		return 0
+	}
+	b := int(math.Ceil(2 * math.Log2(float64(d)/float64(bucketBase))))
+	if b >= numBuckets {
+		b = numBuckets - 1
+	}
+	return b
+}
+
+// bucketBound returns the upper bound of bucket b.
+func bucketBound(b int) time.Duration {
+	return time.Duration(float64(bucketBase) * math.Pow(2, float64(b)/2))
+}
+
+// MethodStats holds the counters kept for a method.
+type MethodStats struct {
+	Calls   int64
+	Errors  int64
+	Total   time.Duration // summed over all calls
+	Longest time.Duration
+
+	buckets [numBuckets]int64
+}
+
+// Mean returns the mean duration of calls to the method.
+func (ms MethodStats) Mean() time.Duration {
+	if ms.Calls == 0 {
+		return 0
+	}
+	return ms.Total / time.Duration(ms.Calls)
+}
+
+// Percentile returns an estimate of the duration within which fraction p
+// (e.g. 0.99) of calls completed. The estimate may be up to 41% too long.
+func (ms MethodStats) Percentile(p float64) time.Duration {
+	if ms.Calls == 0 {
+		return 0
+	}
+	want := int64(math.Ceil(p * float64(ms.Calls)))
+	var n int64
+	for b, c := range ms.buckets {
+		if n += c; n >= want {
+			if d := bucketBound(b); d < ms.Longest {
+				return d
+			}
+			break
+		}
+	}
+	return ms.Longest
+}
+
+func (ms *MethodStats) add(d time.Duration, err error) {
+	ms.Calls++
+	if err != nil {
+		ms.Errors++
+	}
+	ms.Total += d
+	if d > ms.Longest {
+		ms.Longest = d
+	}
+	ms.buckets[bucket(d)]++
+}
+
+// CallStats counts calls and their durations by method. Its Intercept
+// method is an Interceptor and its Varz method is a varz function, e.g.
+//
+//	stats := new(birpc.CallStats)
+//	e := &birpc.Endpoint{Server: srv, ServerInterceptors: []birpc.Interceptor{stats.Intercept}}
+//	server.Varz.Register(stats.Varz, "birpc")
+//
+// The zero value is ready to use.
+type CallStats struct {
+	mu      sync.Mutex
+	methods map[string]*MethodStats
+}
+
+// Intercept records the outcome and duration of each call.
+func (cs *CallStats) Intercept(c *Call, next func() error) error {
+	start := time.Now()
+	err := next()
+	cs.record(c.Method, time.Since(start), err)
+	return err
+}
+
+func (cs *CallStats) record(method string, d time.Duration, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.methods == nil {
+		cs.methods = make(map[string]*MethodStats)
+	}
+	ms := cs.methods[method]
+	if ms == nil {
+		ms = new(MethodStats)
+		cs.methods[method] = ms
+	}
+	ms.add(d, err)
+}
+
+// Stats returns a copy of the counters for each method called so far.
+func (cs *CallStats) Stats() map[string]MethodStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	r := make(map[string]MethodStats, len(cs.methods))
+	for m, ms := range cs.methods {
+		r[m] = *ms
+	}
+	return r
+}
+
+// Varz writes the counters for each method.
+func (cs *CallStats) Varz(w io.Writer) error {
+	stats := cs.Stats()
+	methods := make([]string, 0, len(stats))
+	for m := range stats {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		ms := stats[m]
+		for _, kv := range [][2]string{
+			{"Calls", fmt.Sprint(ms.Calls)},
+			{"Errors", fmt.Sprint(ms.Errors)},
+			{"MeanLatency", fmt.Sprint(ms.Mean())},
+			{"P99Latency", fmt.Sprint(ms.Percentile(0.99))},
+			{"MaxLatency", fmt.Sprint(ms.Longest)},
+		} {
+			if err := varz.Write(m+"."+kv[0], kv[1], w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PeerStats describes the calls made over a connection.
+type PeerStats struct {
+	Serving int // calls from the peer being served
+	Calling int // calls to the peer awaiting a reply
+
+	// Served and Called count the completed calls from and to the peer by
+	// method.
+	Served map[string]MethodStats
+	Called map[string]MethodStats
+}
+
+// Stats returns the counters for calls from and to the peer, including
+// those made directly with Client.
+func (p *Peer) Stats() PeerStats {
+	return PeerStats{
+		Serving: p.server.inFlight(),
+		Calling: p.client.inFlight(),
+		Served:  p.server.stats.Stats(),
+		Called:  p.client.stats.Stats(),
+	}
+}
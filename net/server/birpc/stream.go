@@ -0,0 +1,195 @@
+package birpc
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// Streaming calls each run over their own multiplexed stream, opened by the
+// caller, so that each has its own flow control. The caller first sends a
+// streamHeader naming the method. Each value sent by either end is preceded
+// by a streamMsg; a streamMsg with End set ends that direction of the call.
+// When the handler returns, the serving end sends a final End carrying its
+// error, if any, and closes the stream.
+
+type streamHeader struct {
+	Method string
+}
+
+type streamMsg struct {
+	End   bool
+	Error string
+}
+
+// A StreamHandler serves a streaming call. It receives the caller's values
+// with st.Recv and sends replies with st.Send. The error it returns, if any,
+// is returned to the caller as an rpc.ServerError.
+//
+// A method returning a stream of replies receives its arguments and sends
+// replies until it is done:
+//
+//	func tail(st *birpc.Stream) error {
+//		var args TailArgs
+//		if err := st.Recv(&args); err != nil {
+//			return err
+//		}
+//		for line := range lines(args.File) {
+//			if err := st.Send(line); err != nil {
+//				return err
+//			}
+//		}
+//		return nil
+//	}
+//
+// A method accepting a stream of arguments receives until Recv returns
+// io.EOF and then sends its reply.
+type StreamHandler func(st *Stream) error
+
+// StreamServer holds the streaming methods served by an Endpoint.
+type StreamServer struct {
+	mu       sync.RWMutex
+	handlers map[string]StreamHandler
+}
+
+// NewStreamServer returns a StreamServer with no methods.
+func NewStreamServer() *StreamServer {
+	return &StreamServer{handlers: make(map[string]StreamHandler)}
+}
+
+// Handle registers h to serve streaming calls of method, e.g. "Logs.Tail".
+func (ss *StreamServer) Handle(method string, h StreamHandler) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.handlers[method] = h
+}
+
+func (ss *StreamServer) handler(method string) StreamHandler {
+	if ss == nil {
+		return nil
+	}
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.handlers[method]
+}
+
+// serve serves a stream opened by the peer.
+func (ss *StreamServer) serve(c net.Conn) {
+	defer c.Close()
+	st := newStream(c)
+	var h streamHeader
+	if err := st.dec.Decode(&h); err != nil {
+		return
+	}
+	st.Method = h.Method
+
+	var err error
+	if handler := ss.handler(h.Method); handler != nil {
+		err = handler(st)
+	} else {
+		err = fmt.Errorf("govtil/net/server/birpc: unknown streaming method %q", h.Method)
+	}
+	m := streamMsg{End: true}
+	if err != nil {
+		m.Error = err.Error()
+	}
+	st.encMu.Lock()
+	st.enc.Encode(&m)
+	st.encMu.Unlock()
+}
+
+// acceptStreams serves streaming calls from the peer until the connection
+// is closed.
+func (p *Peer) acceptStreams(ss *StreamServer) {
+	l := p.session.Listener()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go ss.serve(c)
+	}
+}
+
+// Stream is one streaming call. Send and Recv may be called concurrently
+// with each other.
+type Stream struct {
+	Method string
+
+	c     net.Conn
+	encMu sync.Mutex
+	enc   *gob.Encoder
+	dec   *gob.Decoder
+	err   error // set once the peer has ended its direction
+}
+
+func newStream(c net.Conn) *Stream {
+	return &Stream{c: c, enc: gob.NewEncoder(c), dec: gob.NewDecoder(c)}
+}
+
+// OpenStream starts a streaming call of method on the peer.
+func (p *Peer) OpenStream(method string) (*Stream, error) {
+	c, err := p.session.Dial()
+	if err != nil {
+		return nil, err
+	}
+	st := newStream(c)
+	st.Method = method
+	if err := st.enc.Encode(&streamHeader{method}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// Send sends v to the other end of the call.
+func (st *Stream) Send(v interface{}) error {
+	st.encMu.Lock()
+	defer st.encMu.Unlock()
+	if err := st.enc.Encode(&streamMsg{}); err != nil {
+		return err
+	}
+	return st.enc.Encode(v)
+}
+
+// CloseSend tells the other end that no more values will be sent. Its Recv
+// then returns io.EOF.
+func (st *Stream) CloseSend() error {
+	st.encMu.Lock()
+	defer st.encMu.Unlock()
+	return st.enc.Encode(&streamMsg{End: true})
+}
+
+// Recv receives a value sent by the other end into v. It returns io.EOF
+// when the other end has called CloseSend or, on the calling end, when the
+// handler has returned successfully. If the handler returned an error, Recv
+// returns it as an rpc.ServerError.
+func (st *Stream) Recv(v interface{}) error {
+	if st.err != nil {
+		return st.err
+	}
+	var m streamMsg
+	if err := st.dec.Decode(&m); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if m.End {
+		st.err = io.EOF
+		if m.Error != "" {
+			st.err = rpc.ServerError(m.Error)
+		}
+		return st.err
+	}
+	return st.dec.Decode(v)
+}
+
+// Close ends the call. On the calling end, it abandons the call if the
+// handler has not yet returned.
+func (st *Stream) Close() error {
+	return st.c.Close()
+}
@@ -0,0 +1,120 @@
+// Package guard protects dangerous handlers, such as those that kill the
+// process, from unauthorized requests.
+//
+// A guarded handler only serves POST requests that pass every check its Guard
+// has. Other requests are refused with 403 Forbidden and logged.
+package guard
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vsekhar/govtil/log"
+)
+
+// Guard decides which requests may reach a guarded handler. A request must
+// pass every check that is set. If none is set, only requests from loopback
+// addresses are allowed.
+type Guard struct {
+	// If not empty, requests must come from an address in one of CIDRs.
+	CIDRs []*net.IPNet
+
+	// If not empty, requests must carry "Authorization: Bearer <Token>".
+	Token string
+
+	// If not nil, requests must be allowed by Allow.
+	Allow func(*http.Request) bool
+}
+
+// Loopback are the CIDRs allowed by a Guard with no checks set.
+var Loopback = MustParseCIDRs("127.0.0.0/8", "::1/128")
+
+// ParseCIDRs parses CIDR strings such as "10.0.0.0/8" for Guard.CIDRs.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// MustParseCIDRs is the same as ParseCIDRs except it panics on error.
+func MustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// Check returns why r is refused, or "" if it is allowed.
+func (g *Guard) Check(r *http.Request) string {
+	if r.Method != "POST" {
+		return "method " + r.Method + " not allowed"
+	}
+	cidrs := g.CIDRs
+	if len(cidrs) == 0 && g.Token == "" && g.Allow == nil {
+		cidrs = Loopback
+	}
+	if len(cidrs) > 0 && !contains(cidrs, r.RemoteAddr) {
+		return "address not allowed"
+	}
+	if g.Token != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(g.Token)) != 1 {
+			return "bad token"
+		}
+	}
+	if g.Allow != nil && !g.Allow(r) {
+		return "refused by Allow"
+	}
+	return ""
+}
+
+func contains(cidrs []*net.IPNet, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range cidrs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type guardedHandler struct {
+	guard *Guard
+	h     http.Handler
+}
+
+// Wrap returns a handler that passes the requests g allows to h.
+func (g *Guard) Wrap(h http.Handler) http.Handler {
+	return &guardedHandler{g, h}
+}
+
+// WrapFunc is the same as Wrap for a handler function.
+func (g *Guard) WrapFunc(hf func(http.ResponseWriter, *http.Request)) http.Handler {
+	return g.Wrap(http.HandlerFunc(hf))
+}
+
+func (gh *guardedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if why := gh.guard.Check(r); why != "" {
+		log.Printf("govtil/net/server/guard: refused %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, why)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	gh.h.ServeHTTP(w, r)
+}
@@ -0,0 +1,62 @@
+package guard
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	req := func(method, addr, token string) *http.Request {
+		r := httptest.NewRequest(method, "/killkillkill", nil)
+		r.RemoteAddr = addr
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return r
+	}
+	for i, c := range []struct {
+		guard *Guard
+		req   *http.Request
+		code  int
+	}{
+		// loopback only by default
+		{&Guard{}, req("POST", "127.0.0.1:1234", ""), http.StatusOK},
+		{&Guard{}, req("POST", "[::1]:1234", ""), http.StatusOK},
+		{&Guard{}, req("GET", "127.0.0.1:1234", ""), http.StatusForbidden},
+		{&Guard{}, req("POST", "10.1.2.3:1234", ""), http.StatusForbidden},
+		{&Guard{CIDRs: []*net.IPNet{}}, req("POST", "127.0.0.1:1234", ""), http.StatusOK},
+		{&Guard{CIDRs: []*net.IPNet{}}, req("POST", "10.1.2.3:1234", ""), http.StatusForbidden},
+
+		{&Guard{CIDRs: MustParseCIDRs("10.0.0.0/8")}, req("POST", "10.1.2.3:1234", ""), http.StatusOK},
+		{&Guard{CIDRs: MustParseCIDRs("10.0.0.0/8")}, req("POST", "127.0.0.1:1234", ""), http.StatusForbidden},
+
+		{&Guard{Token: "secret"}, req("POST", "10.1.2.3:1234", "secret"), http.StatusOK},
+		{&Guard{Token: "secret"}, req("POST", "10.1.2.3:1234", "wrong"), http.StatusForbidden},
+		{&Guard{Token: "secret"}, req("POST", "127.0.0.1:1234", ""), http.StatusForbidden},
+		{&Guard{Token: "secret"}, req("PUT", "10.1.2.3:1234", "secret"), http.StatusForbidden},
+
+		{&Guard{Allow: func(r *http.Request) bool { return r.URL.Query().Get("yes") != "" }},
+			req("POST", "10.1.2.3:1234", ""), http.StatusForbidden},
+
+		// all checks must pass
+		{&Guard{CIDRs: Loopback, Token: "secret"}, req("POST", "127.0.0.1:1234", "secret"), http.StatusOK},
+		{&Guard{CIDRs: Loopback, Token: "secret"}, req("POST", "10.1.2.3:1234", "secret"), http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		c.guard.Wrap(ok).ServeHTTP(w, c.req)
+		if w.Code != c.code {
+			t.Errorf("%d: got %d, want %d", i, w.Code, c.code)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	if _, err := ParseCIDRs("10.0.0.0/8", "not a cidr"); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -1,8 +1,25 @@
 // Package healthz provides a simple healthz implementation
+//
+// Each registered check runs under its own timeout, and its result may be
+// cached for a while so that frequent health checks do not overload the
+// process. Checks may instead run in the background on a schedule, with
+// requests served their latest results. Requests with format=json in their
+// query receive the result of every check, and with history=1 also the
+// recent results of each.
+//
+// A check can be made to tolerate occasional failures, so that it is only
+// reported unhealthy after several consecutive ones. Every change in a
+// check's reported health is logged.
 package healthz
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/vsekhar/govtil/log"
 )
@@ -10,49 +27,367 @@ import (
 // A function that returns a health status as a bool (true == OK)
 type HealthzFunc func() bool
 
-type subHealthzHandler struct {
-	HealthzFunc
-	string
+// Status is the health of a check
+type Status int
+
+const (
+	Healthy Status = iota
+	Unhealthy
+)
+
+func (s Status) String() string {
+	if s == Healthy {
+		return "OK"
+	}
+	return "UNHEALTHY"
+}
+
+func (s Status) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
 }
 
-type healthzHandler struct {
-	handlers []*subHealthzHandler
+// Result is the outcome of a check. Message says why a check is unhealthy,
+// or gives other detail.
+type Result struct {
+	Status  Status
+	Message string
+}
+
+// A function that checks some aspect of health. It should return promptly
+// once ctx is done.
+type CheckFunc func(ctx context.Context) Result
+
+// Default timeout and caching period of checks registered without their own,
+// and number of results kept for each check.
+var (
+	DefaultTimeout     = 5 * time.Second
+	DefaultCacheFor    = time.Duration(0) // no caching
+	DefaultHistorySize = 10
+)
+
+// CheckOptions configure a check. Zero values use the Handler's Timeout and
+// CacheFor.
+type CheckOptions struct {
+	// Timeout limits how long the check may take. A check that times out
+	// is unhealthy.
+	Timeout time.Duration
+
+	// CacheFor is how long a result is reused before the check is run
+	// again.
+	CacheFor time.Duration
+
+	// If not zero, the check runs every Interval in the background rather
+	// than when requests are received, and requests are served its latest
+	// result. CacheFor is then ignored.
+	Interval time.Duration
+
+	// FailureThreshold is the number of consecutive failures after which
+	// the check is reported unhealthy. If zero, a single failure is enough.
+	FailureThreshold int
+}
+
+type check struct {
+	name       string
+	f          CheckFunc
+	opts       CheckOptions
+	background bool // runs every opts.Interval rather than per request
+
+	mu       sync.Mutex
+	last     CheckResult
+	at       time.Time
+	running  chan struct{} // closed when the run in progress finishes
+	failures int           // consecutive
+	history  []CheckResult // oldest first, as run rather than as reported
+}
+
+// CheckResult is the result of a check as reported by a Handler.
+type CheckResult struct {
+	Name    string
+	Status  Status
+	Time    time.Time // when the check finished
+	Latency time.Duration
+	Message string
+	Cached  bool // Result is from an earlier run
+
+	// Recent results, oldest first. Only set when requested.
+	History []CheckResult
+}
+
+// MarshalJSON reports the latency in seconds.
+func (r CheckResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name    string        `json:"name"`
+		Status  Status        `json:"status"`
+		Time    time.Time     `json:"time"`
+		Latency float64       `json:"latency"`
+		Message string        `json:"message,omitempty"`
+		Cached  bool          `json:"cached,omitempty"`
+		History []CheckResult `json:"history,omitempty"`
+	}{r.Name, r.Status, r.Time, r.Latency.Seconds(), r.Message, r.Cached, r.History})
+}
+
+// Report is the result of all the checks of a Handler.
+type Report struct {
+	Status Status        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// Handler is an http.Handler that reports healthy only if all of its
+// registered checks do
+type Handler struct {
+	// Timeout and CacheFor apply to checks registered without their own. If
+	// zero, DefaultTimeout and DefaultCacheFor are used.
+	Timeout  time.Duration
+	CacheFor time.Duration
+
+	// HistorySize is the number of results kept for each check. If zero,
+	// DefaultHistorySize is used.
+	HistorySize int
+
+	mu     sync.RWMutex
+	checks []*check
+	stop   chan struct{} // closed by Close to stop background checks
+	closed bool
 }
 
 // Create a new healthz handler, an http.Handler that aggregates healthz
-// responses from a number of registered HealthzFunc's
-func NewHandler() *healthzHandler {
-	return &healthzHandler{}
+// responses from a number of registered checks
+func NewHandler() *Handler {
+	return &Handler{}
 }
 
 // Register a HealthzFunc to be polled when a healthz request is received
-func (hh *healthzHandler) Register(hf HealthzFunc, name string) {
-	hh.handlers = append(hh.handlers, &subHealthzHandler{hf, name})
+func (hh *Handler) Register(hf HealthzFunc, name string) {
+	hh.RegisterCheck(name, func(context.Context) Result {
+		if hf() {
+			return Result{Status: Healthy}
+		}
+		return Result{Status: Unhealthy, Message: "failed"}
+	}, nil)
+}
+
+// RegisterCheck registers a CheckFunc to be run when a healthz request is
+// received, or in the background if opts has an Interval. opts may be nil.
+// Once the Handler is closed, checks with an Interval are instead run when
+// requests are received, as if they had none.
+func (hh *Handler) RegisterCheck(name string, cf CheckFunc, opts *CheckOptions) {
+	c := &check{name: name, f: cf}
+	if opts != nil {
+		c.opts = *opts
+	}
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	hh.checks = append(hh.checks, c)
+	if c.opts.Interval > 0 && !hh.closed {
+		c.background = true
+		if hh.stop == nil {
+			hh.stop = make(chan struct{})
+		}
+		go hh.background(c, hh.stop)
+	}
+}
+
+// background runs c every Interval until stop is closed.
+func (hh *Handler) background(c *check, stop <-chan struct{}) {
+	t := time.NewTicker(c.opts.Interval)
+	defer t.Stop()
+	for {
+		hh.run(c, true)
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close stops the background checks. Their last results continue to be
+// served.
+func (hh *Handler) Close() {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	if !hh.closed && hh.stop != nil {
+		close(hh.stop)
+	}
+	hh.closed = true
+}
+
+// History returns the recent results of the named check, oldest first.
+func (hh *Handler) History(name string) []CheckResult {
+	hh.mu.RLock()
+	defer hh.mu.RUnlock()
+	for _, c := range hh.checks {
+		if c.name == name {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return append([]CheckResult(nil), c.history...)
+		}
+	}
+	return nil
+}
+
+func (hh *Handler) options(c *check) (timeout, cacheFor time.Duration) {
+	timeout, cacheFor = c.opts.Timeout, c.opts.CacheFor
+	if timeout == 0 {
+		timeout = hh.Timeout
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	if cacheFor == 0 {
+		cacheFor = hh.CacheFor
+	}
+	if cacheFor == 0 {
+		cacheFor = DefaultCacheFor
+	}
+	return
+}
+
+// run returns the result of c, from the cache if it is recent enough or if c
+// runs in the background, unless force is set. If c is already running, its
+// result is shared.
+func (hh *Handler) run(c *check, force bool) CheckResult {
+	timeout, cacheFor := hh.options(c)
+	c.mu.Lock()
+	if !force && !c.at.IsZero() && (c.background || cacheFor > 0 && time.Since(c.at) < cacheFor) {
+		r := c.last
+		c.mu.Unlock()
+		r.Cached = true
+		return r
+	}
+	if running := c.running; running != nil {
+		c.mu.Unlock()
+		<-running
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.last
+	}
+	c.running = make(chan struct{})
+	c.mu.Unlock()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan Result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- Result{Status: Unhealthy, Message: fmt.Sprint("panic: ", p)}
+			}
+		}()
+		done <- c.f(ctx)
+	}()
+	var res Result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		res = Result{Status: Unhealthy, Message: fmt.Sprintf("timed out after %v", timeout)}
+	}
+	r := CheckResult{
+		Name:    c.name,
+		Status:  res.Status,
+		Time:    time.Now(),
+		Latency: time.Since(start),
+		Message: res.Message,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r = hh.record(c, r)
+	close(c.running)
+	c.running = nil
+	return r
+}
+
+// record adds r to the history of c and returns it as reported: healthy
+// until the failure threshold is reached. c.mu must be held.
+func (hh *Handler) record(c *check, r CheckResult) CheckResult {
+	n := hh.HistorySize
+	if n == 0 {
+		n = DefaultHistorySize
+	}
+	c.history = append(c.history, r)
+	if len(c.history) > n {
+		c.history = c.history[len(c.history)-n:]
+	}
+
+	if r.Status == Healthy {
+		c.failures = 0
+	} else {
+		c.failures++
+		if k := c.opts.FailureThreshold; c.failures < k {
+			r.Status = Healthy
+			r.Message = fmt.Sprintf("%d of %d failures: %s", c.failures, k, r.Message)
+		}
+	}
+
+	prev := Healthy // until first run
+	if !c.at.IsZero() {
+		prev = c.last.Status
+	}
+	if r.Status != prev {
+		log.Printf("govtil/net/server/healthz: %s is now %v: %s", c.name, r.Status, r.Message)
+	}
+	c.last, c.at = r, r.Time
+	return r
+}
+
+// Check runs all the registered checks concurrently and reports their
+// results, in the order they were registered.
+func (hh *Handler) Check() *Report {
+	hh.mu.RLock()
+	checks := hh.checks
+	hh.mu.RUnlock()
+
+	rep := &Report{Checks: make([]CheckResult, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *check) {
+			defer wg.Done()
+			rep.Checks[i] = hh.run(c, false)
+		}(i, c)
+	}
+	wg.Wait()
+	for _, r := range rep.Checks {
+		if r.Status != Healthy {
+			rep.Status = Unhealthy
+		}
+	}
+	return rep
 }
 
 // Serve an HTTP request (do not call this, it is exported so net/http can
 // access it)
-func (hh *healthzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	repch := make(chan bool) 
-	for _, handler := range hh.handlers {
-		go func(h *subHealthzHandler) {
-			healthy := h.HealthzFunc()
-			if healthy {
-				repch <- healthy
-			} else {
-				log.Println("healthz failed:", h.string)
-			}
-		}(handler)
+func (hh *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rep := hh.Check()
+	code := http.StatusOK
+	if rep.Status != Healthy {
+		code = http.StatusInternalServerError
 	}
-	ret := true
-	for _ = range hh.handlers {
-		if !<-repch {
-			ret = false
+	if r.FormValue("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if r.FormValue("history") != "" {
+			for i := range rep.Checks {
+				rep.Checks[i].History = hh.History(rep.Checks[i].Name)
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rep); err != nil {
+			log.Printf("govtil/net/server/healthz: %v", err)
 		}
+		return
 	}
-	if ret {
+	w.WriteHeader(code)
+	if rep.Status == Healthy {
 		w.Write([]byte("OK\n"))
-	} else {
-		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, rep.Status)
+	for _, c := range rep.Checks {
+		if c.Status != Healthy {
+			fmt.Fprintf(w, "%s: %s\n", c.Name, c.Message)
+		}
 	}
 }
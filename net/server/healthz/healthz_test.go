@@ -0,0 +1,194 @@
+package healthz
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func get(h http.Handler, url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	return w
+}
+
+func TestHealthz(t *testing.T) {
+	hh := NewHandler()
+	hh.Register(func() bool { return true }, "ok")
+	if w := get(hh, "/healthz"); w.Code != http.StatusOK || w.Body.String() != "OK\n" {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+
+	// a failing check does not hang the request, and says what failed
+	hh.Register(func() bool { return false }, "bad")
+	hh.RegisterCheck("slow", func(ctx context.Context) Result {
+		<-ctx.Done()
+		return Result{Status: Healthy}
+	}, &CheckOptions{Timeout: 10 * time.Millisecond})
+	hh.RegisterCheck("panics", func(context.Context) Result {
+		panic("oops")
+	}, nil)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- get(hh, "/healthz") }()
+	var w *httptest.ResponseRecorder
+	select {
+	case w = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("healthz hung")
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d", w.Code)
+	}
+	for _, s := range []string{"bad: failed", "slow: timed out", "panics: panic: oops"} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("missing %q in:\n%s", s, w.Body.String())
+		}
+	}
+
+	w = get(hh, "/healthz?format=json")
+	var rep struct {
+		Status string
+		Checks []struct {
+			Name    string
+			Status  string
+			Latency float64
+			Message string
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("%v in:\n%s", err, w.Body.String())
+	}
+	if w.Code != http.StatusInternalServerError || rep.Status != "UNHEALTHY" || len(rep.Checks) != 4 {
+		t.Fatalf("got %d:\n%s", w.Code, w.Body.String())
+	}
+	if c := rep.Checks[0]; c.Name != "ok" || c.Status != "OK" {
+		t.Errorf("got %+v", c)
+	}
+	if c := rep.Checks[2]; c.Name != "slow" || c.Status != "UNHEALTHY" || c.Latency < 0.01 {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestCache(t *testing.T) {
+	hh := NewHandler()
+	var runs int32
+	hh.RegisterCheck("counted", func(context.Context) Result {
+		atomic.AddInt32(&runs, 1)
+		return Result{Status: Healthy}
+	}, &CheckOptions{CacheFor: time.Hour})
+	for i := 0; i < 3; i++ {
+		rep := hh.Check()
+		if cached := rep.Checks[0].Cached; cached != (i > 0) {
+			t.Errorf("%d: cached %v", i, cached)
+		}
+	}
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("check ran %d times", n)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	var c Conditions
+	if r := c.Check(context.Background()); r.Status != Healthy {
+		t.Errorf("zero Conditions: %+v", r)
+	}
+	c.Add("b", "a")
+	if r := c.Check(context.Background()); r.Status != Unhealthy || r.Message != "waiting for a, b" {
+		t.Errorf("got %+v", r)
+	}
+	c.Done("a")
+	c.Done("b")
+	if r := c.Check(context.Background()); r.Status != Healthy {
+		t.Errorf("got %+v", r)
+	}
+}
+
+func TestBackground(t *testing.T) {
+	hh := &Handler{HistorySize: 3}
+	defer hh.Close()
+	var mu sync.Mutex
+	next := Result{Status: Healthy}
+	hh.RegisterCheck("db", func(context.Context) Result {
+		mu.Lock()
+		defer mu.Unlock()
+		return next
+	}, &CheckOptions{Interval: time.Hour, FailureThreshold: 2})
+
+	// the first run is in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hh.History("db")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("check not run in the background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if r := hh.Check().Checks[0]; r.Status != Healthy || !r.Cached {
+		t.Errorf("background result: %+v", r)
+	}
+
+	// later runs are made here rather than waiting for the schedule
+	run := func(r Result) CheckResult {
+		mu.Lock()
+		next = r
+		mu.Unlock()
+		hh.run(hh.checks[0], true)
+		return hh.Check().Checks[0]
+	}
+	bad := Result{Status: Unhealthy, Message: "down"}
+	if r := run(bad); r.Status != Healthy || r.Message != "1 of 2 failures: down" {
+		t.Errorf("after one failure: %+v", r)
+	}
+	if r := run(bad); r.Status != Unhealthy || r.Message != "down" {
+		t.Errorf("after two failures: %+v", r)
+	}
+	if r := run(Result{Status: Healthy}); r.Status != Healthy {
+		t.Errorf("after recovery: %+v", r)
+	}
+
+	h := hh.History("db")
+	if len(h) != 3 {
+		t.Fatalf("history has %d results, want 3", len(h))
+	}
+	for i, want := range []Status{Unhealthy, Unhealthy, Healthy} {
+		if h[i].Status != want {
+			t.Errorf("history %d: got %v, want %v", i, h[i].Status, want)
+		}
+		if i > 0 && h[i].Time.Before(h[i-1].Time) {
+			t.Errorf("history out of order")
+		}
+	}
+
+	w := get(hh, "/healthz?format=json&history=1")
+	if !strings.Contains(w.Body.String(), `"history"`) {
+		t.Errorf("no history in:\n%s", w.Body.String())
+	}
+}
+
+func TestRegisterAfterClose(t *testing.T) {
+	hh := NewHandler()
+	hh.Close()
+	var runs int32
+	hh.RegisterCheck("late", func(context.Context) Result {
+		if atomic.AddInt32(&runs, 1) > 1 {
+			return Result{Status: Unhealthy, Message: "down"}
+		}
+		return Result{Status: Healthy}
+	}, &CheckOptions{Interval: time.Hour})
+
+	// with no background runs, each request runs the check
+	if r := hh.Check().Checks[0]; r.Status != Healthy || r.Cached {
+		t.Errorf("first check: %+v", r)
+	}
+	if r := hh.Check().Checks[0]; r.Status != Unhealthy || r.Cached {
+		t.Errorf("second check: %+v", r)
+	}
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("check ran %d times, want 2", n)
+	}
+}
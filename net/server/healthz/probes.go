@@ -0,0 +1,74 @@
+package healthz
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Probes are the registries of a process's probes: Live fails when the
+// process should be restarted, Ready fails when it should not be sent
+// traffic, and Startup fails until it has finished starting.
+type Probes struct {
+	Live, Ready, Startup *Handler
+}
+
+// NewProbes returns Probes with empty registries.
+func NewProbes() *Probes {
+	return &Probes{
+		Live:    NewHandler(),
+		Ready:   NewHandler(),
+		Startup: NewHandler(),
+	}
+}
+
+// DefaultProbes are served by the Default server of govtil/net/server.
+var DefaultProbes = NewProbes()
+
+// Conditions is a set of named conditions that must all be marked done, such
+// as the steps of starting up. Its Check is healthy once none is pending.
+// The zero value has no pending conditions.
+type Conditions struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// Add adds pending conditions.
+func (c *Conditions) Add(names ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		c.pending = make(map[string]bool)
+	}
+	for _, n := range names {
+		c.pending[n] = true
+	}
+}
+
+// Done marks a condition done.
+func (c *Conditions) Done(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, name)
+}
+
+// Pending returns the names of the conditions not yet done, in order.
+func (c *Conditions) Pending() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for n := range c.pending {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check is a CheckFunc reporting unhealthy while any condition is pending.
+func (c *Conditions) Check(context.Context) Result {
+	if p := c.Pending(); len(p) > 0 {
+		return Result{Status: Unhealthy, Message: "waiting for " + strings.Join(p, ", ")}
+	}
+	return Result{Status: Healthy}
+}
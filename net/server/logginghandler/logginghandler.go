@@ -41,6 +41,12 @@ func (lh *loggingResponseWriter) Hijack() (c net.Conn, rw *bufio.ReadWriter, err
 	return lh.ResponseWriter.(http.Hijacker).Hijack()
 }
 
+func (lh *loggingResponseWriter) Flush() {
+	if f, ok := lh.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 type loggingHandler struct {
 	loglevel int
 	http.Handler
@@ -0,0 +1,195 @@
+// Package pprofz serves runtime profiling data in the format expected by the
+// pprof tool, as net/http/pprof does. Unlike net/http/pprof, importing it
+// registers nothing on http.DefaultServeMux, so profiles are only served
+// where a Handler is installed.
+package pprofz
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vsekhar/govtil/log"
+)
+
+// Prefix is the path under which a Handler expects to be installed.
+const Prefix = "/debug/pprof/"
+
+// Handler is an http.Handler that serves the index of profiles at Prefix and
+// the profiles themselves below it:
+//
+//	/debug/pprof/<name>   a profile from runtime/pprof, e.g. heap or goroutine
+//	/debug/pprof/profile  CPU profile for ?seconds= (default 30)
+//	/debug/pprof/trace    execution trace for ?seconds= (default 1)
+//	/debug/pprof/cmdline  command line of the process
+//	/debug/pprof/symbol   symbols for program counters
+type Handler struct{}
+
+// Create a new pprofz handler
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// Serve an HTTP request (do not call this, it is exported so net/http can
+// access it)
+func (Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	switch name := strings.TrimPrefix(r.URL.Path, Prefix); name {
+	case "":
+		index(w)
+	case "profile":
+		cpuProfile(w, r)
+	case "trace":
+		execTrace(w, r)
+	case "cmdline":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+	case "symbol":
+		symbol(w, r)
+	default:
+		profile(w, r, name)
+	}
+}
+
+var indexTmpl = template.Must(template.New("index").Parse(`<html>
+<head><title>/debug/pprof/</title></head>
+<body>
+<p>Profiles:</p>
+<table>
+{{range .}}<tr><td>{{.Count}}</td><td><a href="{{.Name}}?debug=1">{{.Name}}</a></td></tr>
+{{end}}</table>
+<p><a href="goroutine?debug=2">full goroutine stack dump</a></p>
+</body>
+</html>
+`))
+
+func index(w http.ResponseWriter) {
+	type entry struct {
+		Name  string
+		Count int
+	}
+	var entries []entry
+	for _, p := range pprof.Profiles() {
+		entries = append(entries, entry{p.Name(), p.Count()})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTmpl.Execute(w, entries); err != nil {
+		log.Printf("govtil/net/server/pprofz: %v", err)
+	}
+}
+
+// seconds returns the duration requested in r's query, or def.
+func seconds(r *http.Request, def time.Duration) (time.Duration, error) {
+	s := r.FormValue("seconds")
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad seconds %q", s)
+	}
+	return time.Duration(n * float64(time.Second)), nil
+}
+
+// sleep waits for d, or until the client goes away.
+func sleep(r *http.Request, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+}
+
+func profile(w http.ResponseWriter, r *http.Request, name string) {
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.Error(w, fmt.Sprintf("unknown profile %q", name), http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	if name == "heap" && r.FormValue("gc") != "" {
+		runtime.GC()
+	}
+	if debug != 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	}
+	if err := p.WriteTo(w, debug); err != nil {
+		log.Printf("govtil/net/server/pprofz: %s: %v", name, err)
+	}
+}
+
+func cpuProfile(w http.ResponseWriter, r *http.Request) {
+	d, err := seconds(r, 30*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// buffered, so that a failure to start can still be reported
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		http.Error(w, "could not enable CPU profiling: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sleep(r, d)
+	pprof.StopCPUProfile()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	buf.WriteTo(w)
+}
+
+func execTrace(w http.ResponseWriter, r *http.Request) {
+	d, err := seconds(r, time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		http.Error(w, "could not enable tracing: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sleep(r, d)
+	trace.Stop()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	buf.WriteTo(w)
+}
+
+// symbol looks up the program counters listed in the request body, or in
+// its query if it has no body, separated by '+'. Requests without any report
+// that symbols are available.
+func symbol(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	var in io.Reader = strings.NewReader(r.URL.RawQuery)
+	if r.Method == http.MethodPost {
+		in = r.Body
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "num_symbols: 1\n")
+	br := bufio.NewReader(in)
+	for {
+		word, err := br.ReadString('+')
+		word = strings.TrimSuffix(word, "+")
+		if pc, perr := strconv.ParseUint(strings.TrimSpace(word), 0, 64); perr == nil && pc != 0 {
+			if f := runtime.FuncForPC(uintptr(pc)); f != nil {
+				fmt.Fprintf(&buf, "%#x %s\n", pc, f.Name())
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	buf.WriteTo(w)
+}
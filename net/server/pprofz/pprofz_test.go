@@ -0,0 +1,41 @@
+package pprofz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func get(h http.Handler, url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	return w
+}
+
+func TestPprofz(t *testing.T) {
+	h := NewHandler()
+	if w := get(h, Prefix); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `href="heap?debug=1"`) {
+		t.Errorf("bad index %d:\n%s", w.Code, w.Body.String())
+	}
+	if w := get(h, Prefix+"goroutine?debug=2"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "TestPprofz") {
+		t.Errorf("bad goroutine dump %d:\n%s", w.Code, w.Body.String())
+	}
+	if w := get(h, Prefix+"heap"); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("bad heap profile %d", w.Code)
+	}
+	if w := get(h, Prefix+"profile?seconds=0.05"); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("bad CPU profile %d: %s", w.Code, w.Body.String())
+	}
+	if w := get(h, Prefix+"profile?seconds=x"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request, got %d", w.Code)
+	}
+	if w := get(h, Prefix+"nosuchprofile"); w.Code != http.StatusNotFound {
+		t.Errorf("expected not found, got %d", w.Code)
+	}
+
+	// unlike net/http/pprof, nothing is registered on DefaultServeMux
+	if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest("GET", Prefix, nil)); pattern != "" {
+		t.Errorf("DefaultServeMux serves %s with %q", Prefix, pattern)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vsekhar/govtil/log"
+)
+
+// exit is os.Exit, replaced in tests.
+var exit = os.Exit
+
+// quit serves /quitquitquit: it shuts the server down and reports progress to
+// the caller until the shutdown is complete. If a ?deadline= duration is
+// given and the shutdown takes longer, the process exits.
+//
+// The connection is hijacked so that the shutdown does not wait for this
+// request to end.
+func (s *Server) quit(w http.ResponseWriter, r *http.Request) {
+	var deadline time.Duration
+	if d := r.FormValue("deadline"); d != "" {
+		var err error
+		if deadline, err = time.ParseDuration(d); err != nil || deadline <= 0 {
+			http.Error(w, "bad deadline: "+d, http.StatusBadRequest)
+			return
+		}
+	}
+	log.Printf("govtil/net/server: quitquitquit from %s", r.RemoteAddr)
+
+	progress := s.watchShutdown()
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		fmt.Fprintln(w, "shutting down")
+		go s.shutdownWithin(deadline, nil)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		log.Errorf("govtil/net/server: quitquitquit: %v", err)
+		go s.shutdownWithin(deadline, nil)
+		return
+	}
+	defer conn.Close()
+
+	var mu sync.Mutex
+	say := func(msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(buf, msg)
+		buf.Flush()
+	}
+	// the body is delimited by closing the connection
+	say("HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Connection: close\r\n\r\n")
+	go s.shutdownWithin(deadline, say)
+	for msg := range progress {
+		say(msg + "\n")
+	}
+}
+
+// shutdownWithin shuts the server down, exiting the process if that takes
+// longer than deadline. If deadline is zero, it waits for the shutdown
+// however long it takes. Before exiting, the reason is passed to say if it is
+// not nil.
+func (s *Server) shutdownWithin(deadline time.Duration, say func(string)) {
+	if deadline > 0 {
+		t := time.AfterFunc(deadline, func() {
+			msg := fmt.Sprintf("shutdown deadline of %v exceeded, exiting", deadline)
+			log.Alwaysln("govtil/net/server:", msg)
+			if say != nil {
+				say(msg + "\n")
+			}
+			exit(1)
+		})
+		defer t.Stop()
+	}
+	s.Shutdown()
+}
+
+// abort serves /abortabortabort: it exits the process immediately, logging
+// the ?reason= given by the caller.
+func abort(w http.ResponseWriter, r *http.Request) {
+	reason := r.FormValue("reason")
+	if reason == "" {
+		reason = "no reason given"
+	}
+	log.Alwaysf("govtil/net/server: abortabortabort from %s: %s", r.RemoteAddr, reason)
+	fmt.Fprintln(w, "aborting")
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	exit(1)
+}
@@ -0,0 +1,170 @@
+// Package rpcz provides a page describing the services served over birpc and
+// the peers connected to them.
+package rpcz
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vsekhar/govtil/log"
+	"github.com/vsekhar/govtil/net/server/birpc"
+)
+
+// Handler is an http.Handler that serves the rpcz page
+type Handler struct {
+	registry *birpc.Registry
+
+	mu       sync.Mutex
+	services []birpc.Service
+}
+
+// Create a new rpcz handler, an http.Handler that describes the services
+// registered with it and the peers in reg. It serves HTML, or JSON if the
+// request has format=json in its query or accepts application/json.
+func NewHandler(reg *birpc.Registry) *Handler {
+	return &Handler{registry: reg}
+}
+
+// Register a receiver to be listed. name may be empty, as for
+// rpc.Server.Register.
+func (rh *Handler) Register(name string, rcvr interface{}) {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	rh.services = append(rh.services, birpc.Describe(name, rcvr))
+}
+
+// Report is the content of the page.
+type Report struct {
+	Services []birpc.Service `json:"services"`
+	Peers    []Peer          `json:"peers"`
+}
+
+// Peer describes a connected peer.
+type Peer struct {
+	ID         uint64            `json:"id"`
+	Name       string            `json:"name"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	RemoteAddr string            `json:"remote_addr"`
+	Connected  time.Time         `json:"connected"`
+	Codec      string            `json:"codec"`
+	Serving    int               `json:"serving"`
+	Calling    int               `json:"calling"`
+	Served     []Method          `json:"served"`
+	Called     []Method          `json:"called"`
+}
+
+// Method holds the counters for calls to one method. Durations are in
+// seconds.
+type Method struct {
+	Method string  `json:"method"`
+	Calls  int64   `json:"calls"`
+	Errors int64   `json:"errors"`
+	Mean   float64 `json:"mean"`
+	P50    float64 `json:"p50"`
+	P90    float64 `json:"p90"`
+	P99    float64 `json:"p99"`
+	Max    float64 `json:"max"`
+}
+
+func methods(stats map[string]birpc.MethodStats) []Method {
+	r := make([]Method, 0, len(stats))
+	for name, ms := range stats {
+		r = append(r, Method{
+			Method: name,
+			Calls:  ms.Calls,
+			Errors: ms.Errors,
+			Mean:   ms.Mean().Seconds(),
+			P50:    ms.Percentile(0.5).Seconds(),
+			P90:    ms.Percentile(0.9).Seconds(),
+			P99:    ms.Percentile(0.99).Seconds(),
+			Max:    ms.Longest.Seconds(),
+		})
+	}
+	sort.Sort(byMethod(r))
+	return r
+}
+
+type byMethod []Method
+
+func (b byMethod) Len() int           { return len(b) }
+func (b byMethod) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byMethod) Less(i, j int) bool { return b[i].Method < b[j].Method }
+
+func (rh *Handler) report() *Report {
+	rh.mu.Lock()
+	r := &Report{Services: append([]birpc.Service(nil), rh.services...)}
+	rh.mu.Unlock()
+	for _, p := range rh.registry.Peers() {
+		st := p.Stats()
+		r.Peers = append(r.Peers, Peer{
+			ID:         p.ID,
+			Name:       p.Name,
+			Metadata:   p.Metadata,
+			RemoteAddr: p.RemoteAddr.String(),
+			Connected:  p.Connected,
+			Codec:      p.Codec,
+			Serving:    st.Serving,
+			Calling:    st.Calling,
+			Served:     methods(st.Served),
+			Called:     methods(st.Called),
+		})
+	}
+	return r
+}
+
+// Serve an HTTP request (do not call this, it is exported so net/http can
+// access it)
+func (rh *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rep := rh.report()
+	var err error
+	if r.FormValue("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(rep)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = page.Execute(w, rep)
+	}
+	if err != nil {
+		log.Println("rpcz failed:", err)
+	}
+}
+
+var page = template.Must(template.New("rpcz").Funcs(template.FuncMap{
+	"dur": func(s float64) string {
+		return time.Duration(s * float64(time.Second)).String()
+	},
+}).Parse(`<html>
+<head><title>rpcz</title></head>
+<body>
+<h1>Services</h1>
+{{range .Services}}
+<h2>{{.Name}}</h2>
+<table>
+<tr><th>Method</th><th>Args</th><th>Reply</th></tr>
+{{range .Methods}}<tr><td>{{.Name}}</td><td>{{.Args}}</td><td>{{.Reply}}</td></tr>
+{{end}}</table>
+{{else}}<p>No services registered.</p>
+{{end}}
+<h1>Peers</h1>
+{{range .Peers}}
+<h2>{{.ID}}: {{.Name}} {{.RemoteAddr}}</h2>
+<p>Connected {{.Connected.Format "2006-01-02 15:04:05 MST"}} using {{.Codec}},
+{{.Serving}} calls being served, {{.Calling}} calls awaiting replies.</p>
+{{if .Served}}<h3>Calls from peer</h3>
+{{template "methods" .Served}}{{end}}
+{{if .Called}}<h3>Calls to peer</h3>
+{{template "methods" .Called}}{{end}}
+{{else}}<p>No peers connected.</p>
+{{end}}
+</body>
+</html>
+{{define "methods"}}<table>
+<tr><th>Method</th><th>Calls</th><th>Errors</th><th>Mean</th><th>50%</th><th>90%</th><th>99%</th><th>Max</th></tr>
+{{range .}}<tr><td>{{.Method}}</td><td>{{.Calls}}</td><td>{{.Errors}}</td><td>{{dur .Mean}}</td><td>{{dur .P50}}</td><td>{{dur .P90}}</td><td>{{dur .P99}}</td><td>{{dur .Max}}</td></tr>
+{{end}}</table>{{end}}
+`))
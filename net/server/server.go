@@ -1,121 +1,698 @@
 // Package server provides a generic process server with healthz, varz and
 // direct socket functionality
+//
+// A Server is created with New and has its own handlers. The package-level
+// variables and functions use the Default server.
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
 	"net/rpc"
+	"os"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/vsekhar/govtil/log"
 	"github.com/vsekhar/govtil/mem"
 	vnet "github.com/vsekhar/govtil/net"
 	"github.com/vsekhar/govtil/net/server/birpc"
 	"github.com/vsekhar/govtil/net/server/borkborkbork"
+	"github.com/vsekhar/govtil/net/server/guard"
 	"github.com/vsekhar/govtil/net/server/healthz"
 	"github.com/vsekhar/govtil/net/server/logginghandler"
+	"github.com/vsekhar/govtil/net/server/pprofz"
+	"github.com/vsekhar/govtil/net/server/rpcz"
+	"github.com/vsekhar/govtil/net/server/streamz"
 	"github.com/vsekhar/govtil/net/server/varz"
+	"github.com/vsekhar/govtil/os/signal"
 )
 
 // TODO: testing using net/http/httptest
 
-// Healthz handler. Use Healthz.Register() to register a healthz function
-var Healthz = healthz.NewHandler()
+// Options configure a Server.
+type Options struct {
+	// Fallback serves requests for paths with no handler on the Server. If
+	// nil, a placeholder page is served.
+	Fallback http.Handler
 
-// Varz handler. Use Varz.Register() to register a varz function
-var Varz = varz.NewHandler()
+	// GracePeriod is how long Shutdown waits for active requests and birpc
+	// sessions to end. If zero, DefaultGracePeriod is used.
+	GracePeriod time.Duration
 
-// StreamzCh is a chan []byte to which streamz values should be written. Use
-// govtil/net/server/streamz.Write() to write to this channel on the server.
-var StreamzCh = make(chan []byte, 50)
+	// LameDuck is how long Shutdown keeps serving after it starts reporting
+	// unavailable on /healthz and /readyz, so that load balancers notice and
+	// stop sending requests before the listeners close. If zero,
+	// DefaultLameDuck is used.
+	LameDuck time.Duration
 
-// RPC is an rpc.Server that handles connections received at the /birpc URL.
-// Use RPC.Register() to register method receivers.
-var BiRPC = rpc.NewServer()
+	// Streamz receives the messages written to StreamzCh and serves them on
+	// /streamz. If nil, a new streamz.Handler is used.
+	Streamz *streamz.Handler
 
-// RPCClientCh is a chan *rpc.Client from which RPC clients should be read.
-// These clients are produced by birpc from incoming connections.
-var BiRPCClientsCh = make(chan *rpc.Client, 50)
+	// If not nil, TLS configures the Server to serve HTTPS.
+	TLS *TLSOptions
 
-// A placeholder root request handler
-func defaultHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "govtil/net/server %s!", r.URL.Path[1:])
+	// If not empty, AdminAddr is the address, e.g. "localhost:8081", on
+	// which ServeForever serves the admin and debug URLs (see ServeForever).
+	// They are then not served on the public port, which carries only "/",
+	// /birpc, /streamz and the handlers registered with Handle and
+	// HandleFunc. See also SetAdminAddr.
+	AdminAddr string
+
+	// AdminGuard authorizes requests to the dangerous admin URLs, which kill
+	// the process or allocate memory. They must also be POST requests. If
+	// nil, only requests from loopback addresses are allowed.
+	AdminGuard *guard.Guard
+
+	// Probes are the registries served on /livez, /readyz and /startupz. If
+	// nil, new ones are used.
+	Probes *healthz.Probes
+}
+
+// DefaultGracePeriod is used by Servers whose Options do not set GracePeriod.
+var DefaultGracePeriod = 30 * time.Second
+
+// DefaultLameDuck is used by Servers whose Options do not set LameDuck. It is
+// read when Shutdown is called, so it can be set for the Default server. By
+// default there is no lame-duck period.
+var DefaultLameDuck time.Duration
+
+// Server serves the URLs listed for ServeForever from its own ServeMux.
+type Server struct {
+	mux      *http.ServeMux
+	admin    *http.ServeMux // admin and debug URLs
+	grace    time.Duration
+	lameDuck time.Duration
+	certs    *certs
+
+	mu           sync.Mutex
+	adminAddr    string
+	servers      []*http.Server
+	hooks        []func()
+	draining     bool
+	shutdownOnce sync.Once
+	watchers     []chan string // receive shutdown progress
+	shutDown     bool
+
+	// Healthz handler. Use Healthz.Register() or Healthz.RegisterCheck() to
+	// register a healthz function
+	Healthz *healthz.Handler
+
+	// Livez, Readyz and Startupz are the liveness, readiness and startup
+	// probes. Readyz fails while the server is shutting down, and both
+	// Readyz and Startupz fail until the StartupConditions are done.
+	Livez    *healthz.Handler
+	Readyz   *healthz.Handler
+	Startupz *healthz.Handler
+
+	// StartupConditions are the conditions the server waits for before it
+	// is ready. Use StartupConditions.Add() and StartupConditions.Done().
+	StartupConditions *healthz.Conditions
+
+	// Varz handler. Use Varz.Register() to register a varz function
+	Varz *varz.Handler
+
+	// StreamzCh is a chan []byte to which streamz values should be written.
+	// Values are passed on to Streamz.
+	StreamzCh chan []byte
+
+	// Streamz handler, streaming values to subscribers of /streamz. Use
+	// Streamz.Write() to write to it directly.
+	Streamz *streamz.Handler
+
+	// BiRPC is an rpc.Server that handles connections received at the
+	// /birpc URL. Use BiRPC.Register() to register method receivers, or
+	// RegisterBiRPC() to also list them on /rpcz.
+	BiRPC *rpc.Server
+
+	// BiRPCClientsCh is a chan *rpc.Client from which RPC clients should be
+	// read. These clients are produced by birpc from incoming connections.
+	BiRPCClientsCh chan *rpc.Client
+
+	// BiRPCPeers records the peers connected at the /birpc URL.
+	BiRPCPeers *birpc.Registry
+
+	// BiRPCStats counts the calls served at the /birpc URL by method. They
+	// are exported on /varz.
+	BiRPCStats *birpc.CallStats
+
+	// BiRPCEndpoint serves connections received at the /birpc URL. Set its
+	// Auth field before serving to authenticate peers.
+	BiRPCEndpoint *birpc.Endpoint
+
+	// Rpcz handler, describing the BiRPC services and peers. Receivers
+	// registered with RegisterBiRPC are listed.
+	Rpcz *rpcz.Handler
 }
 
-func init() {
-	http.Handle("/", http.HandlerFunc(defaultHandler))
-	http.Handle("/healthz", Healthz)
-	http.Handle("/varz", Varz)
-	http.Handle("/birpc", birpc.Handler(BiRPC, BiRPCClientsCh))
+// New returns a Server with its handlers registered. opts may be nil.
+func New(opts *Options) *Server {
+	if opts == nil {
+		opts = &Options{}
+	}
+	s := &Server{
+		mux:            http.NewServeMux(),
+		adminAddr:      opts.AdminAddr,
+		grace:          opts.GracePeriod,
+		lameDuck:       opts.LameDuck,
+		Healthz:        healthz.NewHandler(),
+		Varz:           varz.NewHandler(),
+		StreamzCh:      make(chan []byte, 50),
+		Streamz:        opts.Streamz,
+		BiRPC:          rpc.NewServer(),
+		BiRPCClientsCh: make(chan *rpc.Client, 50),
+		BiRPCPeers:     new(birpc.Registry),
+		BiRPCStats:     new(birpc.CallStats),
+	}
+	s.BiRPCEndpoint = &birpc.Endpoint{
+		Server:             s.BiRPC,
+		Clients:            s.BiRPCClientsCh,
+		Registry:           s.BiRPCPeers,
+		ServerInterceptors: []birpc.Interceptor{s.BiRPCStats.Intercept},
+	}
+	s.Rpcz = rpcz.NewHandler(s.BiRPCPeers)
+	if s.grace == 0 {
+		s.grace = DefaultGracePeriod
+	}
+	if opts.TLS != nil {
+		s.certs = newCerts(opts.TLS)
+	}
+	if s.Streamz == nil {
+		s.Streamz = streamz.NewHandler()
+	}
+	probes := opts.Probes
+	if probes == nil {
+		probes = healthz.NewProbes()
+	}
+	s.Livez, s.Readyz, s.Startupz = probes.Live, probes.Ready, probes.Startup
+	s.StartupConditions = new(healthz.Conditions)
+	s.Startupz.RegisterCheck("startup", s.StartupConditions.Check, nil)
+	s.Readyz.RegisterCheck("startup", s.StartupConditions.Check, nil)
+	s.Readyz.RegisterCheck("shutdown", s.notShuttingDown, nil)
+	go s.Streamz.Serve(s.StreamzCh)
+
+	if opts.Fallback != nil {
+		s.mux.Handle("/", opts.Fallback)
+	} else {
+		s.mux.Handle("/", http.HandlerFunc(defaultHandler))
+	}
+	s.mux.Handle("/birpc", s.BiRPCEndpoint.Handler())
+	// streamz is for the application's subscribers, so stays public
+	s.mux.Handle("/streamz", s.Streamz)
+
+	// admin and debug
+	s.admin = http.NewServeMux()
+	s.admin.HandleFunc("/healthz", s.healthz)
+	s.admin.Handle("/livez", s.Livez)
+	s.admin.HandleFunc("/readyz", s.readyz)
+	s.admin.Handle("/startupz", s.Startupz)
+	s.admin.Handle("/varz", s.Varz)
+	s.Varz.Register(s.Streamz.Varz, "streamz")
+	s.Varz.Register(s.BiRPCStats.Varz, "birpc")
+	s.admin.Handle("/rpcz", s.Rpcz)
 
+	g := opts.AdminGuard
+	if g == nil {
+		g = &guard.Guard{}
+	}
 	killHandler := borkborkbork.New(syscall.SIGKILL)
 	intHandler := borkborkbork.New(syscall.SIGINT)
-	http.Handle("/killkillkill", killHandler)
-	http.Handle("/intintint", intHandler)
+	s.admin.Handle("/killkillkill", g.Wrap(killHandler))
+	s.admin.Handle("/intintint", g.Wrap(intHandler))
+	s.admin.Handle("/quitquitquit", g.WrapFunc(s.quit))
+	s.admin.Handle("/abortabortabort", g.WrapFunc(abort))
 
 	// mem
-	Varz.Register(mem.Varz, "mem")
-	http.HandleFunc("/create", mem.Create)
-	http.HandleFunc("/delete", mem.Delete)
-	http.HandleFunc("/gc", mem.GC)
+	s.Varz.Register(mem.Varz, "mem")
+	s.admin.Handle("/create", g.WrapFunc(mem.Create))
+	s.admin.Handle("/delete", g.WrapFunc(mem.Delete))
+	s.admin.Handle("/gc", g.WrapFunc(mem.GC))
+
+	// pprof
+	s.admin.Handle(pprofz.Prefix, pprofz.NewHandler())
+	return s
+}
+
+// A placeholder root request handler
+func defaultHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "govtil/net/server %s!", r.URL.Path[1:])
+}
+
+// Default is the Server used by the package-level variables and functions.
+// Requests for paths it has no handler for are passed to
+// http.DefaultServeMux if it has one, so that handlers registered with
+// http.Handle are still served. Its Streamz is streamz.Default, so values
+// written with streamz.Write() are served on its /streamz, and its probes are
+// healthz.DefaultProbes.
+var Default = New(&Options{
+	Fallback: http.HandlerFunc(defaultFallback),
+	Streamz:  streamz.Default,
+	Probes:   healthz.DefaultProbes,
+})
+
+func defaultFallback(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := http.DefaultServeMux.Handler(r); pattern != "" {
+		http.DefaultServeMux.ServeHTTP(w, r)
+		return
+	}
+	defaultHandler(w, r)
+}
+
+// The handlers of the Default server; see the fields of Server.
+var (
+	Healthz           = Default.Healthz
+	Livez             = Default.Livez
+	Readyz            = Default.Readyz
+	Startupz          = Default.Startupz
+	StartupConditions = Default.StartupConditions
+	Varz              = Default.Varz
+	StreamzCh         = Default.StreamzCh
+	Streamz           = Default.Streamz
+	BiRPC             = Default.BiRPC
+	BiRPCClientsCh    = Default.BiRPCClientsCh
+	BiRPCPeers        = Default.BiRPCPeers
+	BiRPCStats        = Default.BiRPCStats
+	BiRPCEndpoint     = Default.BiRPCEndpoint
+	Rpcz              = Default.Rpcz
+)
+
+// RegisterBiRPC registers rcvr with BiRPC and lists it on /rpcz. A panic in
+// one of its methods fails the call rather than the process; see
+// birpc.Register.
+func (s *Server) RegisterBiRPC(rcvr interface{}) error {
+	return s.RegisterBiRPCName("", rcvr)
+}
+
+// RegisterBiRPCName is like RegisterBiRPC, but uses name for the service, as
+// rpc.Server.RegisterName does.
+func (s *Server) RegisterBiRPCName(name string, rcvr interface{}) error {
+	if err := birpc.RegisterName(s.BiRPC, name, rcvr); err != nil {
+		return err
+	}
+	s.Rpcz.Register(name, rcvr)
+	return nil
+}
+
+// RegisterBiRPC registers rcvr with the Default server's BiRPC.
+func RegisterBiRPC(rcvr interface{}) error {
+	return Default.RegisterBiRPC(rcvr)
+}
+
+// RegisterBiRPCName registers rcvr with the Default server's BiRPC.
+func RegisterBiRPCName(name string, rcvr interface{}) error {
+	return Default.RegisterBiRPCName(name, rcvr)
+}
+
+// Handle registers h for path on the server.
+func (s *Server) Handle(path string, h http.Handler) {
+	s.mux.Handle(path, h)
+}
+
+// HandleFunc registers hf for path on the server.
+func (s *Server) HandleFunc(path string, hf func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(path, hf)
+}
+
+// ServeHTTP dispatches a request to the server's handlers. If the server has
+// an AdminAddr, the admin and debug URLs are not included; see AdminHandler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.getAdminAddr() == "" {
+		if _, pattern := s.admin.Handler(r); pattern != "" {
+			s.admin.ServeHTTP(w, r)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// AdminHandler returns the handler for the admin and debug URLs alone,
+// without "/", /birpc, /streamz or the handlers registered with Handle and
+// HandleFunc.
+func (s *Server) AdminHandler() http.Handler {
+	return s.admin
+}
+
+// SetAdminAddr sets the address on which ServeForever serves the admin and
+// debug URLs, as Options.AdminAddr does, and stops serving them on the public
+// port. It is meant for servers such as Default that are not created with
+// their own Options, and must be called before the server is served.
+func (s *Server) SetAdminAddr(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adminAddr = addr
+}
+
+func (s *Server) getAdminAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.adminAddr
 }
 
 func Handle(path string, h http.Handler) {
-	http.Handle(path, h)
+	Default.Handle(path, h)
 }
 
 func HandleFunc(path string, hf func(http.ResponseWriter, *http.Request)) {
-	http.HandleFunc(path, hf)
+	Default.HandleFunc(path, hf)
 }
 
 // Serve on a given port
 //
 // The server will log to the default logger and will gracefully terminate on
-// receipt of an interrupt or kill signal.
+// receipt of an interrupt or kill signal (see Shutdown).
 //
 // The following URLs are defined:
 //    /
+//    /birpc
+//    /streamz
+//
+// along with the admin and debug URLs:
 //    /healthz
+//    /livez, /readyz, /startupz
 //    /varz
-//    /streamz
-//    /birpc
+//    /rpcz
+//    /killkillkill, /intintint
+//    /quitquitquit, /abortabortabort
+//    /create, /delete, /gc
 //    /debug/pprof
 //
+// If the server has an AdminAddr, the admin and debug URLs are served on a
+// separate listener at that address instead. /killkillkill, /intintint,
+// /quitquitquit, /abortabortabort, /create, /delete and /gc only accept POST
+// requests allowed by the AdminGuard.
+//
 // Setting port to 0 will start the server on an ephemeral port. The assigned
 // port will be logged.
-func ServeForever(port int) error {
-	l, err := vnet.SignalListener(port)
+//
+// If the server has TLSOptions, it serves HTTPS, and SIGHUP reloads the
+// certificates rather than stopping the server.
+//
+// The first stop signal shuts the server down gracefully; a second one
+// terminates the process immediately.
+func (s *Server) ServeForever(port int) error {
+	l, err := net.Listen("tcp", ":"+fmt.Sprint(port))
 	if err != nil {
 		log.Errorf("govtil/net/server: failed to open port: %v", err)
 		return err
 	}
-	return ServeListenerForever(l)
+	if addr := s.getAdminAddr(); addr != "" {
+		al, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Errorf("govtil/net/server: failed to open admin address: %v", err)
+			l.Close()
+			return err
+		}
+		go s.ServeAdminListener(al)
+	}
+	stop := signal.StopSignals
+	if s.certs != nil {
+		stop = nil
+		for _, sig := range signal.StopSignals {
+			if sig != syscall.SIGHUP {
+				stop = append(stop, sig)
+			}
+		}
+	}
+	signal.GoCustom(func(sig os.Signal) {
+		log.Printf("govtil/net/server: received %v", sig)
+		s.Shutdown()
+	}, stop)
+	return s.ServeListenerForever(l)
 }
 
 // ServeListenerForever is the same as ServeForever except it uses the specified
 // listener. This is useful in testing when an ephemeral port should be used.
-func ServeListenerForever(l net.Listener) error {
+//
+// It returns once the server has shut down, either because Shutdown was
+// called or because l was closed. If the server has TLSOptions, l is wrapped
+// to serve HTTPS.
+func (s *Server) ServeListenerForever(l net.Listener) error {
+	err := s.serve(l, s, "")
+	s.Shutdown()
+	log.Println("govtil/net/server: Terminating")
+	return err
+}
+
+// ServeAdminListener serves the admin and debug URLs on l, for a server with
+// an AdminAddr whose public port is served with ServeListenerForever. Only
+// the admin and debug URLs are served on l. It returns once the server has
+// shut down or l was closed, but does not itself shut the server down.
+func (s *Server) ServeAdminListener(l net.Listener) error {
+	return s.serve(l, s.AdminHandler(), "admin ")
+}
+
+// serve serves h on l until the server shuts down or l is closed.
+func (s *Server) serve(l net.Listener, h http.Handler, what string) error {
+	if s.certs != nil {
+		if err := s.certs.start(); err != nil {
+			log.Errorf("govtil/net/server: failed to load TLS certificates: %v", err)
+			l.Close()
+			return err
+		}
+		l = tls.NewListener(l, s.certs.tlsConfig())
+	}
+
 	// Wrap with logger
-	handler := logginghandler.New(http.DefaultServeMux, log.GetVerbosity())
+	hs := &http.Server{Handler: logginghandler.New(h, log.GetVerbosity())}
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.servers = append(s.servers, hs)
+	s.mu.Unlock()
 
 	_, aps, err := net.SplitHostPort(l.Addr().String())
 	if err != nil {
 		log.Errorf("govtil/net/server: failed to get port - %v", err)
 	}
-	log.Printf("govtil/net/server: starting on port %v", aps)
+	log.Printf("govtil/net/server: starting %son port %v", what, aps)
 
 	// Serve
-	err = http.Serve(l, handler)
-	if err != nil {
-		if vnet.SocketClosed(err) {
-			err = nil // closed due to signal, no error
-		} else {
-			log.Errorf("govtil/net/server: %v", err)
-		}
+	err = hs.Serve(l)
+	if err == http.ErrServerClosed || vnet.SocketClosed(err) {
+		err = nil // closed due to shutdown or signal, no error
+	} else {
+		log.Errorf("govtil/net/server: %v", err)
 	}
-	log.Println("govtil/net/server: Terminating")
 	return err
 }
+
+// OnShutdown registers f to be run when the server shuts down, after active
+// requests and birpc sessions have ended or the grace period has passed.
+// Hooks run in the order they were registered.
+func (s *Server) OnShutdown(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, f)
+}
+
+// Shutdown gracefully stops the server. It reports unavailable on /healthz
+// and /readyz so that load balancers drain the server, and keeps serving for
+// the lame-duck period while they notice. It then stops accepting
+// connections and waits up to the grace period for active requests and birpc
+// sessions to end. Sessions still open after the grace period are closed.
+// Finally, the shutdown hooks are run.
+//
+// Shutdown returns once all of this is done, and may be called more than
+// once. Hooks must not call it.
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(s.shutdown)
+}
+
+func (s *Server) shutdown() {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	if d := s.lameDuckPeriod(); d > 0 {
+		s.progress("lame duck for %v", d)
+		time.Sleep(d)
+	}
+	s.mu.Lock()
+	servers := s.servers
+	s.mu.Unlock()
+	s.progress("shutting down, waiting up to %v", s.grace)
+
+	// streamz subscriptions never end on their own
+	s.Streamz.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.grace)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, hs := range servers {
+		wg.Add(1)
+		go func(hs *http.Server) {
+			defer wg.Done()
+			if err := hs.Shutdown(ctx); err != nil {
+				s.progress("requests still active: %v", err)
+				hs.Close()
+			}
+		}(hs)
+	}
+	wg.Wait()
+
+	s.progress("requests drained")
+
+	if n := s.BiRPCPeers.Len(); n > 0 {
+		s.progress("waiting for %d birpc sessions", n)
+		select {
+		case <-s.BiRPCPeers.Empty():
+		case <-ctx.Done():
+		}
+	}
+	if n := s.BiRPCPeers.Len(); n > 0 {
+		s.progress("closing %d birpc sessions", n)
+		s.BiRPCPeers.Each(func(p *birpc.Peer) {
+			p.Close()
+		})
+	}
+
+	if s.certs != nil {
+		s.certs.close()
+	}
+	for _, hh := range []*healthz.Handler{s.Healthz, s.Livez, s.Readyz, s.Startupz} {
+		hh.Close() // stop background checks
+	}
+
+	s.mu.Lock()
+	hooks := s.hooks
+	s.mu.Unlock()
+	if len(hooks) > 0 {
+		s.progress("running %d shutdown hooks", len(hooks))
+	}
+	for _, f := range hooks {
+		f()
+	}
+	s.progress("shut down")
+
+	s.mu.Lock()
+	s.shutDown = true
+	for _, ch := range s.watchers {
+		close(ch)
+	}
+	s.watchers = nil
+	s.mu.Unlock()
+}
+
+func (s *Server) lameDuckPeriod() time.Duration {
+	if s.lameDuck != 0 {
+		return s.lameDuck
+	}
+	return DefaultLameDuck
+}
+
+// progress logs a step of the shutdown and passes it on to watchers.
+func (s *Server) progress(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("govtil/net/server: %s", msg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.watchers {
+		select {
+		case ch <- msg:
+		default: // watcher is not keeping up
+		}
+	}
+}
+
+// watchShutdown returns a channel receiving the progress of the shutdown,
+// which is closed once the shutdown is complete.
+func (s *Server) watchShutdown() <-chan string {
+	ch := make(chan string, 16)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutDown {
+		close(ch)
+	} else {
+		s.watchers = append(s.watchers, ch)
+	}
+	return ch
+}
+
+// notShuttingDown is a readiness check that fails once Shutdown is called.
+func (s *Server) notShuttingDown(context.Context) healthz.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return healthz.Result{Status: healthz.Unhealthy, Message: "shutting down"}
+	}
+	return healthz.Result{Status: healthz.Healthy}
+}
+
+// healthz reports unhealthy while the server is shutting down, and otherwise
+// defers to Healthz.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	draining := s.draining
+	s.mu.Unlock()
+	if draining {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	s.Healthz.ServeHTTP(w, r)
+}
+
+// readyz serves Readyz, which fails while the server is shutting down. It
+// then reports 503 Service Unavailable rather than an internal error, as
+// /healthz does.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	draining := s.draining
+	s.mu.Unlock()
+	if draining {
+		w = unavailableWriter{w}
+	}
+	s.Readyz.ServeHTTP(w, r)
+}
+
+// unavailableWriter replaces server error statuses with 503 Service
+// Unavailable.
+type unavailableWriter struct {
+	http.ResponseWriter
+}
+
+func (u unavailableWriter) WriteHeader(code int) {
+	if code >= 500 {
+		code = http.StatusServiceUnavailable
+	}
+	u.ResponseWriter.WriteHeader(code)
+}
+
+// ServeForever serves the Default server on a given port.
+func ServeForever(port int) error {
+	return Default.ServeForever(port)
+}
+
+// ServeListenerForever serves the Default server on l.
+func ServeListenerForever(l net.Listener) error {
+	return Default.ServeListenerForever(l)
+}
+
+// ServeAdminListener serves the Default server's admin and debug URLs on l.
+// Call SetAdminAddr first so that they are not also served on the public
+// port.
+func ServeAdminListener(l net.Listener) error {
+	return Default.ServeAdminListener(l)
+}
+
+// SetAdminAddr sets the address on which ServeForever serves the Default
+// server's admin and debug URLs.
+func SetAdminAddr(addr string) {
+	Default.SetAdminAddr(addr)
+}
+
+// OnShutdown registers f to run when the Default server shuts down.
+func OnShutdown(f func()) {
+	Default.OnShutdown(f)
+}
+
+// Shutdown gracefully stops the Default server.
+func Shutdown() {
+	Default.Shutdown()
+}
@@ -2,12 +2,29 @@ package server
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/vsekhar/govtil/log"
+	"github.com/vsekhar/govtil/net/server/birpc"
+	"github.com/vsekhar/govtil/net/server/rpcz"
 	vtest "github.com/vsekhar/govtil/testing"
 )
 
@@ -42,3 +59,698 @@ func TestServer(t *testing.T) {
 		t.Errorf("failed health check, expected '%s', got '%s'", OK, health)
 	}
 }
+
+type Echo struct{}
+
+type EchoArgs struct {
+	S string
+}
+
+func (e *Echo) Echo(args *EchoArgs, reply *string) error {
+	*reply = args.S
+	return nil
+}
+
+func (e *Echo) unexported(args *EchoArgs, reply *string) error {
+	return nil
+}
+
+func TestRpcz(t *testing.T) {
+	s := New(nil)
+	if err := s.RegisterBiRPC(new(Echo)); err != nil {
+		t.Fatalf("RegisterBiRPC: %v", err)
+	}
+	l, port, err := vtest.LocalListener()
+	if err != nil {
+		t.Fatalf("LocalListener: %v", err)
+	}
+	go s.ServeListenerForever(l)
+	defer s.Shutdown()
+	base := fmt.Sprintf("http://localhost:%d", port)
+	p, err := (&birpc.Endpoint{Name: "tester"}).Dial(fmt.Sprintf("ws://localhost:%d/birpc", port))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer p.Close()
+	var reply string
+	if err := p.Call("Echo.Echo", &EchoArgs{"hi"}, &reply); err != nil || reply != "hi" {
+		t.Fatalf("Call: %q, %v", reply, err)
+	}
+
+	resp, err := http.Get(base + "/rpcz?format=json")
+	if err != nil {
+		t.Fatalf("failed to get rpcz: %v", err)
+	}
+	var rep rpcz.Report
+	err = json.NewDecoder(resp.Body).Decode(&rep)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode rpcz: %v", err)
+	}
+	if len(rep.Services) != 1 || rep.Services[0].Name != "Echo" ||
+		len(rep.Services[0].Methods) != 1 || rep.Services[0].Methods[0].Args != "*server.EchoArgs" {
+		t.Errorf("bad services %+v", rep.Services)
+	}
+	var peer *rpcz.Peer
+	for i := range rep.Peers {
+		if rep.Peers[i].Name == "tester" {
+			peer = &rep.Peers[i]
+		}
+	}
+	if peer == nil {
+		t.Fatalf("peer not listed in %+v", rep.Peers)
+	}
+	if len(peer.Served) != 1 || peer.Served[0].Method != "Echo.Echo" || peer.Served[0].Calls != 1 {
+		t.Errorf("bad peer stats %+v", peer)
+	}
+
+	resp, err = http.Get(base + "/rpcz")
+	if err != nil {
+		t.Fatalf("failed to get rpcz: %v", err)
+	}
+	page, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Contains(page, []byte("Echo.Echo")) {
+		t.Errorf("bad rpcz page (%v):\n%s", err, page)
+	}
+}
+
+func TestTwoServers(t *testing.T) {
+	get := func(port int, path string) (int, string) {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	var ports []int
+	var checks []chan bool
+	for i := 0; i < 2; i++ {
+		s := New(nil)
+		checked := make(chan bool, 1)
+		s.Healthz.Register(func() bool {
+			checked <- true
+			return true
+		}, "test")
+		checks = append(checks, checked)
+		name := fmt.Sprint("server", i)
+		s.HandleFunc("/name", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+		l, port, err := vtest.LocalListener()
+		if err != nil {
+			t.Fatalf("LocalListener: %v", err)
+		}
+		defer l.Close()
+		go s.ServeListenerForever(l)
+		ports = append(ports, port)
+	}
+
+	for i, port := range ports {
+		if _, name := get(port, "/name"); name != fmt.Sprint("server", i) {
+			t.Errorf("server %d: got name %q", i, name)
+		}
+	}
+	// each server only runs its own checks
+	if code, _ := get(ports[1], "/healthz"); code != http.StatusOK {
+		t.Errorf("server 1: expected healthy, got %d", code)
+	}
+	select {
+	case <-checks[0]:
+		t.Errorf("server 0 check run for server 1")
+	case <-checks[1]:
+	}
+	if _, body := get(ports[1], "/varz"); !strings.Contains(body, "Alloc") {
+		t.Errorf("server 1: missing mem varz in:\n%s", body)
+	}
+}
+
+func TestSetAdminAddr(t *testing.T) {
+	s := New(&Options{Fallback: http.NotFoundHandler()})
+	s.HandleFunc("/app", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app"))
+	})
+	get := func(h http.Handler, path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	// the admin handler never serves the public URLs
+	if code := get(s.AdminHandler(), "/app"); code != http.StatusNotFound {
+		t.Errorf("admin handler served /app: %d", code)
+	}
+	if code := get(s, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz before SetAdminAddr: got %d", code)
+	}
+	s.SetAdminAddr("localhost:0")
+	for _, c := range []struct {
+		h    http.Handler
+		path string
+		code int
+	}{
+		{s, "/app", http.StatusOK},
+		{s, "/healthz", http.StatusNotFound},
+		{s, "/debug/pprof/", http.StatusNotFound},
+		{s.AdminHandler(), "/app", http.StatusNotFound},
+		{s.AdminHandler(), "/healthz", http.StatusOK},
+	} {
+		if code := get(c.h, c.path); code != c.code {
+			t.Errorf("%s: got %d, want %d", c.path, code, c.code)
+		}
+	}
+}
+
+func TestAdminAddr(t *testing.T) {
+	s := New(&Options{Fallback: http.NotFoundHandler(), AdminAddr: "localhost:0"})
+	s.HandleFunc("/app", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app"))
+	})
+	var ports []int
+	for _, serve := range []func(net.Listener) error{s.ServeListenerForever, s.ServeAdminListener} {
+		l, port, err := vtest.LocalListener()
+		if err != nil {
+			t.Fatalf("LocalListener: %v", err)
+		}
+		go serve(l)
+		ports = append(ports, port)
+	}
+	defer s.Shutdown()
+
+	for _, c := range []struct {
+		port int
+		path string
+		code int
+	}{
+		{ports[0], "/app", http.StatusOK},
+		{ports[0], "/healthz", http.StatusNotFound},
+		{ports[0], "/varz", http.StatusNotFound},
+		{ports[0], "/killkillkill", http.StatusNotFound},
+		{ports[0], "/debug/pprof/", http.StatusNotFound},
+		{ports[0], "/streamz", http.StatusOK},
+		{ports[1], "/streamz", http.StatusNotFound},
+		{ports[1], "/app", http.StatusNotFound},
+		{ports[1], "/healthz", http.StatusOK},
+		{ports[1], "/varz", http.StatusOK},
+		{ports[1], "/debug/pprof/", http.StatusOK},
+		{ports[1], "/gc", http.StatusForbidden}, // GET is refused
+	} {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", c.port, c.path))
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", c.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Errorf("port %d %s: got %d, want %d", c.port, c.path, resp.StatusCode, c.code)
+		}
+	}
+	resp, err := http.Post(fmt.Sprintf("http://localhost:%d/gc", ports[1]), "", nil)
+	if err != nil {
+		t.Fatalf("failed to post /gc: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /gc from localhost: got %d", resp.StatusCode)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := New(&Options{GracePeriod: 200 * time.Millisecond})
+	started := make(chan bool)
+	release := make(chan bool)
+	s.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		w.Write([]byte("done"))
+	})
+	var order []int
+	for i := 0; i < 3; i++ {
+		i := i
+		s.OnShutdown(func() { order = append(order, i) })
+	}
+	l, port, err := vtest.LocalListener()
+	if err != nil {
+		t.Fatalf("LocalListener: %v", err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.ServeListenerForever(l)
+	}()
+
+	// an active request is allowed to finish
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/slow", port))
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+	<-started
+	shutdown := make(chan bool)
+	go func() {
+		s.Shutdown()
+		close(shutdown)
+	}()
+
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		if w.Code == http.StatusServiceUnavailable {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected unhealthy while shutting down, got %d", w.Code)
+	}
+	select {
+	case <-shutdown:
+		t.Fatalf("shutdown did not wait for active request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if b := <-body; b != "done" {
+		t.Errorf("active request failed: %s", b)
+	}
+	<-shutdown
+	if err := <-served; err != nil {
+		t.Errorf("ServeListenerForever: %v", err)
+	}
+	if fmt.Sprint(order) != "[0 1 2]" {
+		t.Errorf("hooks ran in order %v", order)
+	}
+}
+
+func TestLameDuck(t *testing.T) {
+	s := New(&Options{LameDuck: 200 * time.Millisecond})
+	l, port, err := vtest.LocalListener()
+	if err != nil {
+		t.Fatalf("LocalListener: %v", err)
+	}
+	go s.ServeListenerForever(l)
+	get := func(path string) int {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("/readyz before shutdown: got %d", code)
+	}
+
+	start := time.Now()
+	shut := make(chan bool)
+	go func() {
+		s.Shutdown()
+		close(shut)
+	}()
+	for i := 0; i < 100 && get("/healthz") == http.StatusOK; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	// still listening, but reporting unavailable
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code := get(path); code != http.StatusServiceUnavailable {
+			t.Errorf("%s during lame duck: got %d", path, code)
+		}
+	}
+	if code := get("/livez"); code != http.StatusOK {
+		t.Errorf("/livez during lame duck: got %d", code)
+	}
+	<-shut
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("shutdown took %v, less than the lame-duck period", d)
+	}
+	if _, err := http.Get(fmt.Sprintf("http://localhost:%d/healthz", port)); err == nil {
+		t.Errorf("still serving after shutdown")
+	}
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	s := New(&Options{GracePeriod: 50 * time.Millisecond})
+	started := make(chan bool)
+	s.HandleFunc("/hang", func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		select {}
+	})
+	l, port, err := vtest.LocalListener()
+	if err != nil {
+		t.Fatalf("LocalListener: %v", err)
+	}
+	go s.ServeListenerForever(l)
+	go http.Get(fmt.Sprintf("http://localhost:%d/hang", port))
+	<-started
+	start := time.Now()
+	s.Shutdown()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("shutdown took %v", d)
+	}
+}
+
+// testCert is a certificate and key, with their PEM encodings.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate for localhost signed by parent, or
+// self-signed if parent is nil.
+func newTestCert(t *testing.T, serial int64, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: fmt.Sprint("test ", serial)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	tc, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "govtil-server-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	write := func(name string, b []byte) {
+		if err := ioutil.WriteFile(name, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ca := newTestCert(t, 1, nil)
+	write(caFile, ca.certPEM)
+	serverCert := newTestCert(t, 2, ca)
+	write(certFile, serverCert.certPEM)
+	write(keyFile, serverCert.keyPEM)
+	clientCert := newTestCert(t, 3, ca)
+
+	s := New(&Options{TLS: &TLSOptions{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ClientCAFile:   caFile,
+		ReloadInterval: 10 * time.Millisecond,
+	}})
+	if err := s.RegisterBiRPC(new(Echo)); err != nil {
+		t.Fatal(err)
+	}
+	l, port, err := vtest.LocalListener()
+	if err != nil {
+		t.Fatalf("LocalListener: %v", err)
+	}
+	go s.ServeListenerForever(l)
+	defer s.Shutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert.tlsCertificate(t)},
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	url := fmt.Sprintf("https://localhost:%d", port)
+	for _, path := range []string{"/healthz", "/varz"} {
+		resp, err := client.Get(url + path)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got %d", path, resp.StatusCode)
+		}
+	}
+
+	// client certificates are required
+	anon := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if resp, err := anon.Get(url + "/healthz"); err == nil {
+		resp.Body.Close()
+		t.Errorf("served client without certificate")
+	}
+
+	// birpc over wss
+	e := &birpc.Endpoint{TLSConfig: config}
+	p, err := e.Dial(fmt.Sprintf("wss://localhost:%d/birpc", port))
+	if err != nil {
+		t.Fatalf("birpc dial: %v", err)
+	}
+	var reply string
+	if err := p.Client.Call("Echo.Echo", &EchoArgs{"hi"}, &reply); err != nil || reply != "hi" {
+		t.Errorf("birpc call: %q, %v", reply, err)
+	}
+	p.Close()
+
+	// changed files are picked up by new connections
+	serial := func() int64 {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", port), config)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if n := serial(); n != 2 {
+		t.Fatalf("got serial %d, want 2", n)
+	}
+	newCert := newTestCert(t, 4, ca)
+	write(keyFile, newCert.keyPEM)
+	write(certFile, newCert.certPEM)
+	// make sure the change is visible even on coarse-grained file systems
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	deadline := time.Now().Add(5 * time.Second)
+	for serial() != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a bad file keeps the previous certificate
+	write(certFile, []byte("garbage"))
+	if err := s.ReloadTLS(); err == nil {
+		t.Errorf("ReloadTLS accepted a bad certificate")
+	}
+	if n := serial(); n != 4 {
+		t.Errorf("got serial %d after failed reload, want 4", n)
+	}
+}
+
+// exits receives the codes passed to exit by the server.
+var exits = make(chan int, 10)
+
+func init() {
+	exit = func(code int) { exits <- code }
+}
+
+func TestQuit(t *testing.T) {
+	post := func(port int, path string) (int, string) {
+		resp, err := http.Post(fmt.Sprintf("http://localhost:%d%s", port, path), "", nil)
+		if err != nil {
+			t.Fatalf("failed to post %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		return resp.StatusCode, string(b)
+	}
+	start := func(s *Server) (int, chan error) {
+		l, port, err := vtest.LocalListener()
+		if err != nil {
+			t.Fatalf("LocalListener: %v", err)
+		}
+		served := make(chan error, 1)
+		go func() { served <- s.ServeListenerForever(l) }()
+		return port, served
+	}
+
+	// orderly shutdown
+	s := New(&Options{GracePeriod: 5 * time.Second})
+	hooked := make(chan bool, 1)
+	s.OnShutdown(func() { hooked <- true })
+	port, served := start(s)
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/quitquitquit", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /quitquitquit: got %d", resp.StatusCode)
+	}
+	code, body := post(port, "/quitquitquit")
+	if code != http.StatusOK || !strings.Contains(body, "running 1 shutdown hooks\nshut down\n") {
+		t.Errorf("got %d:\n%s", code, body)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ServeListenerForever: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still serving")
+	}
+	select {
+	case <-hooked:
+	default:
+		t.Errorf("hook not run")
+	}
+
+	// a request that outlives the deadline forces an exit
+	s = New(&Options{GracePeriod: 500 * time.Millisecond})
+	entered, release := make(chan bool), make(chan bool)
+	s.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-release
+	})
+	port, served = start(s)
+	defer close(release)
+	go http.Get(fmt.Sprintf("http://localhost:%d/slow", port))
+	<-entered
+	code, body = post(port, "/quitquitquit?deadline=50ms")
+	if !strings.Contains(body, "deadline of 50ms exceeded") {
+		t.Errorf("got %d:\n%s", code, body)
+	}
+	select {
+	case c := <-exits:
+		if c != 1 {
+			t.Errorf("exit code %d", c)
+		}
+	default:
+		t.Errorf("no exit")
+	}
+	<-served
+
+	// abort exits right away
+	s = New(nil)
+	port, _ = start(s)
+	defer s.Shutdown()
+	if code, _ := post(port, "/quitquitquit?deadline=soon"); code != http.StatusBadRequest {
+		t.Errorf("bad deadline: got %d", code)
+	}
+	post(port, "/abortabortabort?reason=testing")
+	select {
+	case c := <-exits:
+		if c != 1 {
+			t.Errorf("exit code %d", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("no exit on abort")
+	}
+}
+
+func TestProbes(t *testing.T) {
+	s := New(&Options{GracePeriod: 5 * time.Second})
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+	s.StartupConditions.Add("cache", "config")
+	for _, path := range []string{"/startupz", "/readyz"} {
+		if code, body := get(path); code == http.StatusOK || !strings.Contains(body, "waiting for cache, config") {
+			t.Errorf("%s before startup: got %d %q", path, code, body)
+		}
+	}
+	if code, _ := get("/livez"); code != http.StatusOK {
+		t.Errorf("/livez: got %d", code)
+	}
+	s.StartupConditions.Done("cache")
+	s.StartupConditions.Done("config")
+	for _, path := range []string{"/startupz", "/readyz", "/livez"} {
+		if code, body := get(path); code != http.StatusOK {
+			t.Errorf("%s after startup: got %d %q", path, code, body)
+		}
+	}
+
+	// not ready while draining a request
+	entered, release := make(chan bool), make(chan bool)
+	s.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-release
+	})
+	l, port, err := vtest.LocalListener()
+	if err != nil {
+		t.Fatalf("LocalListener: %v", err)
+	}
+	go s.ServeListenerForever(l)
+	go http.Get(fmt.Sprintf("http://localhost:%d/slow", port))
+	<-entered
+	shut := make(chan bool)
+	go func() {
+		s.Shutdown()
+		close(shut)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, body := get("/readyz")
+		if code != http.StatusOK && strings.Contains(body, "shutdown: shutting down") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still ready while shutting down: %d %q", code, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code, _ := get("/livez"); code != http.StatusOK {
+		t.Errorf("/livez while shutting down: got %d", code)
+	}
+	close(release)
+	<-shut
+}
@@ -0,0 +1,264 @@
+// Package streamz provides a streamz implementation: messages written to a
+// Handler are fanned out to every connected subscriber, over Server-Sent
+// Events or a websocket.
+//
+// Each subscriber has its own buffer, so a slow subscriber does not hold up
+// the writer or other subscribers. When a subscriber's buffer is full, the
+// Handler's Policy decides what is dropped.
+package streamz
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/vsekhar/govtil/log"
+	"github.com/vsekhar/govtil/net/server/varz"
+)
+
+// Policy decides what happens to a message for a subscriber whose buffer is
+// full.
+type Policy int
+
+const (
+	DropOldest Policy = iota // discard the oldest buffered message
+	DropNewest               // discard the new message
+	Disconnect               // disconnect the subscriber
+)
+
+// DefaultBuffer is the number of messages buffered for each subscriber of a
+// Handler whose Buffer is zero.
+const DefaultBuffer = 64
+
+// Handler is an http.Handler that streams the messages written to it to each
+// subscriber. Requests with a websocket upgrade receive each message as a
+// text frame, others receive Server-Sent Events.
+type Handler struct {
+	// Buffer and Policy apply to subscribers connecting after they are set.
+	Buffer int
+	Policy Policy
+
+	messages     int64
+	dropped      int64
+	disconnected int64
+
+	mu     sync.Mutex
+	subs   map[*subscriber]bool
+	closed bool
+}
+
+type subscriber struct {
+	ch      chan []byte
+	die     chan struct{} // closed when the subscriber must disconnect
+	policy  Policy
+	dropped int64
+}
+
+// Create a new streamz handler with no subscribers
+func NewHandler() *Handler {
+	return &Handler{subs: make(map[*subscriber]bool)}
+}
+
+// Default is the Handler written to by the package-level Write.
+var Default = NewHandler()
+
+// Write sends b to the subscribers of the Default handler.
+func Write(b []byte) {
+	Default.Write(b)
+}
+
+// Write sends b to every subscriber. It does not block, and b may be reused
+// once it returns.
+func (h *Handler) Write(b []byte) {
+	b = append([]byte(nil), b...)
+	atomic.AddInt64(&h.messages, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		select {
+		case s.ch <- b:
+			continue
+		default:
+		}
+		atomic.AddInt64(&h.dropped, 1)
+		atomic.AddInt64(&s.dropped, 1)
+		switch s.policy {
+		case DropOldest:
+			select {
+			case <-s.ch:
+			default:
+			}
+			select {
+			case s.ch <- b:
+			default:
+			}
+		case Disconnect:
+			atomic.AddInt64(&h.disconnected, 1)
+			h.remove(s)
+		}
+	}
+}
+
+// Serve writes each message received from ch until ch is closed.
+func (h *Handler) Serve(ch <-chan []byte) {
+	for b := range ch {
+		h.Write(b)
+	}
+}
+
+// Close disconnects all subscribers and refuses new ones.
+func (h *Handler) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.remove(s)
+	}
+}
+
+func (h *Handler) subscribe() *subscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	n := h.Buffer
+	if n <= 0 {
+		n = DefaultBuffer
+	}
+	s := &subscriber{
+		ch:     make(chan []byte, n),
+		die:    make(chan struct{}),
+		policy: h.Policy,
+	}
+	if h.subs == nil {
+		h.subs = make(map[*subscriber]bool)
+	}
+	h.subs[s] = true
+	return s
+}
+
+// remove disconnects s. h.mu must be held.
+func (h *Handler) remove(s *subscriber) {
+	if h.subs[s] {
+		delete(h.subs, s)
+		close(s.die)
+	}
+}
+
+func (h *Handler) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// Subscribers returns the number of connected subscribers.
+func (h *Handler) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// Serve an HTTP request (do not call this, it is exported so net/http can
+// access it)
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Handler(h.serveWebsocket).ServeHTTP(w, r)
+		return
+	}
+	h.serveEvents(w, r)
+}
+
+func (h *Handler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streamz: streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	s := h.subscribe()
+	if s == nil {
+		http.Error(w, "streamz: shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	for {
+		select {
+		case b := <-s.ch:
+			if err := writeEvent(w, b); err != nil {
+				return
+			}
+			f.Flush()
+		case <-s.die:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes b as a Server-Sent Event, one data field per line.
+func writeEvent(w io.Writer, b []byte) error {
+	for _, line := range strings.Split(string(b), "\n") {
+		if _, err := fmt.Fprintf(w, "data: %s\n", line); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func (h *Handler) serveWebsocket(ws *websocket.Conn) {
+	s := h.subscribe()
+	if s == nil {
+		return
+	}
+	defer h.unsubscribe(s)
+
+	// anything the subscriber sends is ignored, but reading notices when it
+	// goes away
+	gone := make(chan struct{})
+	go func() {
+		var msg []byte
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+		close(gone)
+	}()
+	for {
+		select {
+		case b := <-s.ch:
+			if err := websocket.Message.Send(ws, string(b)); err != nil {
+				log.Debugf("govtil/net/server/streamz: %v", err)
+				return
+			}
+		case <-s.die:
+			return
+		case <-gone:
+			return
+		}
+	}
+}
+
+// Varz writes the handler's counters.
+func (h *Handler) Varz(w io.Writer) error {
+	for _, kv := range [][2]string{
+		{"Subscribers", fmt.Sprint(h.Subscribers())},
+		{"Messages", fmt.Sprint(atomic.LoadInt64(&h.messages))},
+		{"Dropped", fmt.Sprint(atomic.LoadInt64(&h.dropped))},
+		{"Disconnected", fmt.Sprint(atomic.LoadInt64(&h.disconnected))},
+	} {
+		if err := varz.Write("streamz."+kv[0], kv[1], w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
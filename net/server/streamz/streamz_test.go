@@ -0,0 +1,126 @@
+package streamz
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// waitSubscribers waits until h has n subscribers.
+func waitSubscribers(t *testing.T, h *Handler, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Subscribers() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("have %d subscribers, want %d", h.Subscribers(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	h := NewHandler()
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("content type %q", ct)
+	}
+	waitSubscribers(t, h, 1)
+
+	h.Write([]byte("one"))
+	h.Write([]byte("two\nlines"))
+	r := bufio.NewReader(resp.Body)
+	var got []string
+	for len(got) < 5 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, strings.TrimSuffix(line, "\n"))
+	}
+	want := []string{"data: one", "", "data: two", "data: lines", ""}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	h.Close()
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("stream still open after Close")
+	}
+	waitSubscribers(t, h, 0)
+}
+
+func TestWebsocket(t *testing.T) {
+	h := NewHandler()
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	var wss []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		ws, err := websocket.Dial(url, "", ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		wss = append(wss, ws)
+	}
+	waitSubscribers(t, h, 2)
+
+	h.Write([]byte("hello"))
+	for i, ws := range wss {
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg != "hello" {
+			t.Errorf("subscriber %d got %q", i, msg)
+		}
+	}
+
+	wss[0].Close()
+	waitSubscribers(t, h, 1)
+}
+
+func TestPolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy  Policy
+		want    []string
+		dropped int64
+		subs    int
+	}{
+		{DropOldest, []string{"2", "3"}, 2, 1},
+		{DropNewest, []string{"0", "1"}, 2, 1},
+		{Disconnect, []string{"0", "1"}, 1, 0},
+	} {
+		h := NewHandler()
+		h.Buffer = 2
+		h.Policy = c.policy
+		s := h.subscribe()
+		for _, m := range []string{"0", "1", "2", "3"} {
+			h.Write([]byte(m))
+		}
+		var got []string
+		for len(s.ch) > 0 {
+			got = append(got, string(<-s.ch))
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("policy %d: got %q, want %q", c.policy, got, c.want)
+		}
+		if s.dropped != c.dropped || h.dropped != c.dropped {
+			t.Errorf("policy %d: dropped %d/%d, want %d", c.policy, s.dropped, h.dropped, c.dropped)
+		}
+		if n := h.Subscribers(); n != c.subs {
+			t.Errorf("policy %d: %d subscribers, want %d", c.policy, n, c.subs)
+		}
+	}
+}
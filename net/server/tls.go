@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	stdsignal "os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vsekhar/govtil/log"
+)
+
+// TLSOptions configure a Server to serve HTTPS.
+type TLSOptions struct {
+	// CertFile and KeyFile name PEM files holding the server's certificate
+	// chain and private key.
+	CertFile, KeyFile string
+
+	// If not empty, ClientCAFile names a PEM bundle of CA certificates.
+	// Clients must then present a certificate signed by one of them.
+	ClientCAFile string
+
+	// ReloadInterval is how often the files are checked for changes. If
+	// zero, DefaultReloadInterval is used; if negative, files are only
+	// reloaded on SIGHUP or by calling ReloadTLS.
+	ReloadInterval time.Duration
+}
+
+// DefaultReloadInterval is used by TLSOptions that do not set ReloadInterval.
+var DefaultReloadInterval = time.Minute
+
+// certs holds the certificates loaded for TLSOptions and reloads them when
+// their files change.
+type certs struct {
+	opts TLSOptions
+
+	startOnce sync.Once
+	startErr  error
+	stop      chan struct{}
+	stopOnce  sync.Once
+
+	mu       sync.RWMutex
+	config   *tls.Config
+	modTimes []time.Time
+}
+
+func newCerts(opts *TLSOptions) *certs {
+	c := &certs{opts: *opts, stop: make(chan struct{})}
+	if c.opts.ReloadInterval == 0 {
+		c.opts.ReloadInterval = DefaultReloadInterval
+	}
+	return c
+}
+
+func (c *certs) files() []string {
+	fs := []string{c.opts.CertFile, c.opts.KeyFile}
+	if c.opts.ClientCAFile != "" {
+		fs = append(fs, c.opts.ClientCAFile)
+	}
+	return fs
+}
+
+func (c *certs) stat() ([]time.Time, error) {
+	var ts []time.Time
+	for _, f := range c.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, fi.ModTime())
+	}
+	return ts, nil
+}
+
+// load reads the files and replaces the config used for new connections. On
+// error, the previous config is kept.
+func (c *certs) load() error {
+	ts, err := c.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.opts.CertFile, c.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if c.opts.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.opts.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", c.opts.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	c.mu.Lock()
+	c.config = config
+	c.modTimes = ts
+	c.mu.Unlock()
+	return nil
+}
+
+// changed reports whether any of the files has changed since they were
+// loaded.
+func (c *certs) changed() bool {
+	ts, err := c.stat()
+	if err != nil {
+		return false // mid-update, try again later
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for i, t := range ts {
+		if !t.Equal(c.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *certs) reload(why string) error {
+	if err := c.load(); err != nil {
+		log.Errorf("govtil/net/server: failed to reload TLS certificates (%s), keeping previous: %v", why, err)
+		return err
+	}
+	log.Printf("govtil/net/server: reloaded TLS certificates (%s)", why)
+	return nil
+}
+
+// start loads the files and watches them for changes, once.
+func (c *certs) start() error {
+	c.startOnce.Do(func() {
+		if c.startErr = c.load(); c.startErr != nil {
+			return
+		}
+		go c.watch()
+	})
+	return c.startErr
+}
+
+func (c *certs) watch() {
+	hup := make(chan os.Signal, 1)
+	stdsignal.Notify(hup, syscall.SIGHUP)
+	defer stdsignal.Stop(hup)
+	var tick <-chan time.Time
+	if c.opts.ReloadInterval > 0 {
+		t := time.NewTicker(c.opts.ReloadInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-hup:
+			c.reload("SIGHUP")
+		case <-tick:
+			if c.changed() {
+				c.reload("files changed")
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *certs) close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// tlsConfig returns a config that uses the most recently loaded certificates
+// for each new connection.
+func (c *certs) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return c.config, nil
+		},
+	}
+}
+
+// ErrNoTLS is returned by ReloadTLS for a Server without TLSOptions.
+var ErrNoTLS = errors.New("govtil/net/server: TLS not configured")
+
+// ReloadTLS reloads the server's certificate, key and client CA files. If
+// they cannot be loaded, the previous ones continue to be used.
+func (s *Server) ReloadTLS() error {
+	if s.certs == nil {
+		return ErrNoTLS
+	}
+	if err := s.certs.start(); err != nil {
+		return err
+	}
+	return s.certs.reload("requested")
+}
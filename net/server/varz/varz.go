@@ -24,20 +24,20 @@ func (svh *subVarzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// VarzHandler is an http.Handler that aggregates varz values from any number
+// Handler is an http.Handler that aggregates varz values from any number
 // of registered VarzFunc's
-type varzHandler struct {
+type Handler struct {
 	multihandler.MultiHandler
 }
 
 // Create a new varz handler, an http.Handler that aggregates varz responses
 // from a number of registered VarzFunc's
-func NewHandler() *varzHandler {
-	return &varzHandler{}
+func NewHandler() *Handler {
+	return &Handler{}
 }
 
 // Register a VarzFunc to be included in varz output
-func (vh *varzHandler) Register(vf VarzFunc, name string) {
+func (vh *Handler) Register(vf VarzFunc, name string) {
 	svh := subVarzHandler{vf, name}
 	vh.MultiHandler.Register(&svh)
 }
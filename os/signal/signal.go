@@ -12,23 +12,30 @@ import (
 // This can be used, for example, to gracefully shutdown a web server
 // (http.Serve() will return when its listen socket is closed).
 func Go(f func(os.Signal)) {
-	stopsigs := []os.Signal{
-		syscall.SIGABRT,
-		syscall.SIGHUP,
-		syscall.SIGINT,
-		syscall.SIGKILL,
-		syscall.SIGPWR,
-		syscall.SIGQUIT,
-		syscall.SIGSTOP,
-		syscall.SIGTERM,
-	}
-	GoCustom(f, stopsigs)
+	GoCustom(f, StopSignals)
 }
 
+// StopSignals are the signals Go waits for.
+var StopSignals = []os.Signal{
+	syscall.SIGABRT,
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGKILL,
+	syscall.SIGPWR,
+	syscall.SIGQUIT,
+	syscall.SIGSTOP,
+	syscall.SIGTERM,
+}
+
+// GoCustom runs f when any of sigs is received by the process. Only the first
+// signal is handled: once it arrives, sigs regain their default behaviour, so
+// that a second SIGINT or SIGTERM terminates a process stuck shutting down.
 func GoCustom(f func(os.Signal), sigs []os.Signal) {
-	sigch := make(chan os.Signal)
+	sigch := make(chan os.Signal, 1) // Notify does not block sending to sigch
 	stdsignal.Notify(sigch, sigs...)
 	go func() {
-		f(<-sigch)
+		sig := <-sigch
+		stdsignal.Stop(sigch)
+		f(sig)
 	}()
 }